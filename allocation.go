@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	modeRanked = "ranked" //按志愿分配
+
+	algorithmRsd = "rsd" //随机顺序依次挑选（random serial dictatorship）
+	algorithmDa  = "da"  //学生申请的延迟接受算法（deferred acceptance）
+
+	priorityGradeDesc = "grade_desc" //高年级优先
+	priorityGradeAsc  = "grade_asc"  //低年级优先
+	priorityNone      = "none"       //只按随机顺序
+)
+
+//学生提交的志愿，Courses按志愿顺序排列
+type preference struct {
+	info      studentInfo
+	Courses   []string `json:"courses"`
+	TimeStamp int64    `json:"timestamp"`
+}
+
+type allocationReport struct {
+	Category   string `json:"category"`
+	Algorithm  string `json:"algorithm"`
+	Seed       int64  `json:"seed"`
+	TimeStamp  int64  `json:"timestamp"`
+	Students   int    `json:"students"`
+	Ranks      []int  `json:"ranks"` //Ranks[i]为分配到第i+1志愿的人数
+	Unassigned int    `json:"unassigned"`
+
+	Assigned map[string]int `json:"assigned,omitempty"` //学生分配到的志愿序号，从0开始，只保存到数据库
+}
+
+func (self SessionConfig) choices() int {
+	if self.Choices <= 0 {
+		return 5
+	}
+	return self.Choices
+}
+
+//提交志愿，courses为空表示撤回志愿，调用者需持有s.m
+func (s *school) submitPreference(student string, courses []string, info studentInfo) (int, string) {
+	if !s.started {
+		return 1, "报名未开始"
+	}
+	if s.mode != modeRanked {
+		return 1, "本次报名不需要填报志愿"
+	}
+	if s.closed {
+		return 1, "志愿填报已截止"
+	}
+	if len(courses) == 0 {
+		delete(s.preferences, student)
+		return 0, "已撤回志愿"
+	}
+	if len(courses) > s.sessionConfig().choices() {
+		return 1, fmt.Sprintf("最多只能填报%d个志愿", s.sessionConfig().choices())
+	}
+
+	seen := map[string]bool{}
+	for _, name := range courses {
+		v := s.findCourse(name)
+		if v == nil || !gradeFilter(v.c.Grade, info.Grade) {
+			return 1, fmt.Sprintf("不能报%s", name)
+		}
+		if seen[name] {
+			return 1, "志愿重复"
+		}
+		seen[name] = true
+	}
+
+	s.preferences[student] = &preference{info, courses, time.Now().Unix()}
+	return 0, "志愿提交成功"
+}
+
+//按学号排序后用种子洗牌，得到每个学生的随机序号，用于决定挑选顺序或同等优先级时的先后
+func lotteryNumbers(students []string, seed int64) map[string]int {
+	order := make([]string, len(students))
+	copy(order, students)
+	sort.Strings(order)
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+
+	numbers := make(map[string]int, len(order))
+	for i, v := range order {
+		numbers[v] = i
+	}
+	return numbers
+}
+
+func (self *courseObj) clone() *courseObj {
+	c := NewCourseObj(self.c)
+	c.c.Number = self.c.Number
+	for k, v := range self.students {
+		c.students[k] = v
+	}
+	for k, v := range self.gradeCount {
+		c.gradeCount[k] = v
+	}
+	for k, v := range self.classCount {
+		c.classCount[k] = v
+	}
+	return c
+}
+
+//随机顺序依次挑选：按随机序号让每个学生选走还有名额的最靠前志愿
+func allocateRsd(courses map[string]*courseObj, prefs map[string]*preference,
+	numbers map[string]int) map[string]int {
+
+	order := make([]string, 0, len(prefs))
+	for k := range prefs {
+		order = append(order, k)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return numbers[order[i]] < numbers[order[j]]
+	})
+
+	assigned := map[string]int{}
+	for _, student := range order {
+		p := prefs[student]
+		for i, name := range p.Courses {
+			v := courses[name]
+			if v.full(p.info) == "" {
+				v.add(student, p.info)
+				assigned[student] = i
+				break
+			}
+		}
+	}
+	return assigned
+}
+
+//学生申请的延迟接受算法：没有被录取的学生依次向下一个志愿申请，课程在
+//已暂时录取和新申请的学生中按优先级重新挑选，直到没有学生需要再申请。
+//课程的总名额、年级和班级名额都在挑选时检查
+func allocateDa(courses map[string]*courseObj, prefs map[string]*preference,
+	less func(a, b string) bool) map[string]int {
+
+	free := make([]string, 0, len(prefs))
+	for k := range prefs {
+		free = append(free, k)
+	}
+	sort.Strings(free)
+
+	held := map[string][]string{}
+	next := map[string]int{}
+	for len(free) > 0 {
+		student := free[0]
+		free = free[1:]
+		p := prefs[student]
+		if next[student] >= len(p.Courses) {
+			continue
+		}
+		name := p.Courses[next[student]]
+		next[student]++
+
+		candidates := append(held[name], student)
+		sort.Slice(candidates, func(i, j int) bool {
+			return less(candidates[i], candidates[j])
+		})
+		seats := courses[name].clone()
+		accepted := make([]string, 0, len(candidates))
+		for _, v := range candidates {
+			info := prefs[v].info
+			if seats.full(info) == "" {
+				seats.add(v, info)
+				accepted = append(accepted, v)
+			} else {
+				free = append(free, v)
+			}
+		}
+		held[name] = accepted
+	}
+
+	assigned := map[string]int{}
+	for name, students := range held {
+		for _, student := range students {
+			courses[name].add(student, prefs[student].info)
+			assigned[student] = next[student] - 1
+		}
+	}
+	return assigned
+}
+
+func (s *school) allocate(seed int64) *allocationReport {
+	cfg := s.sessionConfig()
+	s.m.Lock()
+	courses := map[string]*courseObj{}
+	for _, v := range s.courses {
+		courses[v.c.Name] = v
+	}
+	students := make([]string, 0, len(s.preferences))
+	for k := range s.preferences {
+		students = append(students, k)
+	}
+	numbers := lotteryNumbers(students, seed)
+
+	report := &allocationReport{Category: s.courseTag, Algorithm: cfg.Algorithm, Seed: seed,
+		TimeStamp: time.Now().Unix(), Students: len(students),
+		Ranks: make([]int, cfg.choices())}
+	if cfg.Algorithm == algorithmDa {
+		grade := func(student string) int {
+			switch cfg.Priority {
+			case priorityNone:
+				return 0
+			case priorityGradeAsc:
+				return -s.preferences[student].info.Grade
+			}
+			return s.preferences[student].info.Grade
+		}
+		report.Assigned = allocateDa(courses, s.preferences, func(a, b string) bool {
+			if grade(a) != grade(b) {
+				return grade(a) > grade(b)
+			}
+			return numbers[a] < numbers[b]
+		})
+	} else {
+		report.Algorithm = algorithmRsd
+		report.Assigned = allocateRsd(courses, s.preferences, numbers)
+	}
+
+	for student, rank := range report.Assigned {
+		v := courses[s.preferences[student].Courses[rank]]
+		s.shard(student).index(student, v)
+		s.registerDb(student, v.c)
+		s.notify(notifyLotteryResult, student, v)
+		report.Ranks[rank]++
+	}
+	report.Unassigned = report.Students - len(report.Assigned)
+	s.closed = true
+	s.report = report
+	s.m.Unlock()
+	s.auditConsole(auditAllocate, fmt.Sprintf("%s algorithm=%s seed=%d",
+		report.Category, report.Algorithm, seed))
+
+	err := dbClient.saveAllocationReport(s.name, report)
+	if err != nil {
+		log.Println(err)
+	}
+	return report
+}
+
+func handlePreference(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	student := r.FormValue("student")
+	if student == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	actor, ok := school.actor(r, student)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !school.onRoster(student) {
+		school.auditRequest(r, auditPreference, actor, student, r.FormValue("courses"), msgNotOnRoster)
+		w.Write([]byte(fmt.Sprintf(`{"errCode":1,"errMsg":"%s"}`, msgNotOnRoster)))
+		return
+	}
+	info, err := school.studentInfo(student)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//courses为按志愿顺序用逗号分隔的课程名称
+	courses := []string{}
+	for _, v := range strings.Split(r.FormValue("courses"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			courses = append(courses, v)
+		}
+	}
+
+	school.m.Lock()
+	errCode, errMsg := school.submitPreference(student, courses, info)
+	school.auditRequest(r, auditPreference, actor, student, strings.Join(courses, ","), errMsg)
+	school.m.Unlock()
+
+	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s"}`, errCode, errMsg)))
+}
+
+func handlePreferenceInfo(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	student := r.FormValue("student")
+	if student == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	info := struct {
+		Courses  []string `json:"courses"`
+		Assigned string   `json:"assigned"` //分配到的课程，未分配或未截止时为空
+		Rank     int      `json:"rank"`     //分配到第几志愿，0表示没有
+	}{Courses: []string{}}
+	school.m.RLock()
+	defer school.m.RUnlock()
+	if p, ok := school.preferences[student]; ok {
+		info.Courses = p.Courses
+		if school.report != nil {
+			if rank, ok := school.report.Assigned[student]; ok && rank < len(p.Courses) {
+				info.Assigned = p.Courses[rank]
+				info.Rank = rank + 1
+			}
+		}
+	}
+
+	b, _ := json.Marshal(&info)
+	w.Write(b)
+}
+
+func handleAllocationReport(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+
+	school.m.RLock()
+	report := school.report
+	var b []byte
+	if report != nil {
+		public := *report
+		public.Assigned = nil
+		b, _ = json.Marshal(&public)
+	} else {
+		b = []byte(`{}`)
+	}
+	school.m.RUnlock()
+	w.Write(b)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditRegister    = "register"
+	auditCancel      = "cancel"
+	auditPreference  = "preference"
+	auditCourseLoad  = "course-load"
+	auditCourseEdit  = "course-edit"
+	auditTimerSet    = "timer-set"
+	auditTimerCancel = "timer-cancel"
+	auditLottery     = "lottery-draw"
+	auditAllocate    = "allocate"
+	auditAdminEnroll = "admin-enroll"
+	auditAdminDrop   = "admin-drop"
+	auditAvatar      = "avatar-upload"
+	auditRoster      = "roster-update"
+
+	actorConsole = "console" //服务器控制台
+	actorAdmin   = "admin"   //通过管理接口操作
+)
+
+//审计记录只追加不修改，每条记录的Hash包含上一条记录的Hash，
+//任何一条记录被修改或删除都会使之后的链条校验失败
+type auditEntry struct {
+	Seq       int64  `json:"seq"`
+	TimeStamp int64  `json:"timestamp"` //服务器时间，毫秒
+	Action    string `json:"action"`
+	Actor     string `json:"actor"` //操作者：学生学号、parent:家长编号、admin或console
+	Student   string `json:"student"`
+	Course    string `json:"course"`
+	Result    string `json:"result"` //操作结果，例如：报名成功、已报满
+	Detail    string `json:"detail"`
+	IP        string `json:"ip"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"`
+}
+
+func (self auditEntry) digest() string {
+	self.Hash = ""
+	b, _ := json.Marshal(&self)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditChain struct {
+	m       sync.Mutex
+	loaded  bool
+	seq     int64
+	last    string
+	pending []auditEntry //无法读取链条末尾时暂存的记录，按发生顺序排列
+	retry   time.Time    //暂存期间下次读取链条末尾的时间
+}
+
+//追加审计记录，记录在持有链条锁时进入写入队列，保证写入顺序与链条顺序一致。
+//时间在调用时确定，调用者应在决定操作结果的锁内调用
+func (s *school) audit(e auditEntry) {
+	c := &s.auditChain
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	e.TimeStamp = time.Now().UnixNano() / int64(time.Millisecond)
+	c.pending = append(c.pending, e)
+	if !c.loaded {
+		if time.Now().Before(c.retry) {
+			return
+		}
+		last, err := dbClient.lastAuditEntry(s.name)
+		if err != nil && err != errNotFound {
+			//无法确定链条末尾时不能继续追加，否则链条会断开，
+			//记录按顺序暂存，之后追加时重新读取
+			log.Printf("audit: %v, %d entries pending", err, len(c.pending))
+			c.retry = time.Now().Add(time.Second)
+			return
+		}
+		c.seq, c.last, c.loaded = last.Seq, last.Hash, true
+	}
+
+	for _, e := range c.pending {
+		c.seq += 1
+		e.Seq = c.seq
+		e.PrevHash = c.last
+		e.Hash = e.digest()
+		c.last = e.Hash
+		dbWrite(&chanAudit{db: s.name, entry: e})
+		recentEvents.add(s.name, e)
+	}
+	c.pending = c.pending[:0]
+}
+
+//请求对应的审计记录，由决定结果的代码填写Result后追加
+func requestAudit(r *http.Request, action, actor, student, course string) auditEntry {
+	return auditEntry{Action: action, Actor: actor, Student: student, Course: course,
+		IP: clientIP(r)}
+}
+
+func (s *school) auditRequest(r *http.Request, action, actor, student, course, result string) {
+	e := requestAudit(r, action, actor, student, course)
+	e.Result = result
+	s.audit(e)
+}
+
+func (s *school) auditConsole(action, detail string) {
+	s.audit(auditEntry{Action: action, Actor: actorConsole, Detail: detail})
+}
+
+type chanAudit struct {
+	queued
+	db    string
+	entry auditEntry
+}
+
+//重放死信时使用，可能已经写入过，按唯一键写入
+func (self *chanAudit) handle() error {
+	_, err := dbClient.appendAudits(self.db, []auditEntry{self.entry}, true)
+	return err
+}
+
+//同一学校的审计记录必须按链条顺序写入，由同一个写入协程处理
+func (self *chanAudit) key() string {
+	return self.db + "/audit"
+}
+
+func (self *chanAudit) batch() string {
+	return "audit/" + self.db
+}
+
+func (self *chanAudit) handleBatch(handlers []chanHandler, retry bool) (int, error) {
+	entries := make([]auditEntry, len(handlers))
+	for i, v := range handlers {
+		entries[i] = v.(*chanAudit).entry
+	}
+	return dbClient.appendAudits(self.db, entries, retry)
+}
+
+func (self *chanAudit) letter() deadLetter {
+	entry := self.entry
+	return deadLetter{Type: letterAudit, Db: self.db, Audit: &entry}
+}
+
+//检查按Seq排列的记录，prev为这些记录之前的一条记录（从头校验时为空），
+//返回第一条校验失败的记录序号，0表示全部通过
+func verifyAudit(prev auditEntry, entries []auditEntry) int64 {
+	for _, e := range entries {
+		if e.Seq != prev.Seq+1 || e.PrevHash != prev.Hash || e.digest() != e.Hash {
+			return e.Seq
+		}
+		prev = e
+	}
+	return 0
+}
+
+const (
+	auditPageSize = 1000  //每次查询默认返回的条数
+	auditMaxPage  = 10000 //每次查询最多返回的条数
+)
+
+func auditLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		return auditPageSize
+	}
+	if limit > auditMaxPage {
+		return auditMaxPage
+	}
+	return limit
+}
+
+//查询审计记录，按seq分页：返回seq大于since的最多limit条记录，
+//next为下一页的since，0表示没有更多记录
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	if school == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from, _ := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	to, _ := strconv.ParseInt(r.FormValue("to"), 10, 64)
+	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	limit := auditLimit(r)
+
+	entries, err := dbClient.queryAudit(school.name, r.FormValue("student"), from, to,
+		since, limit)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	next := int64(0)
+	if len(entries) == limit {
+		next = entries[len(entries)-1].Seq
+	}
+	b, _ := json.Marshal(&struct {
+		Data []auditEntry `json:"data"`
+		Next int64        `json:"next"`
+	}{entries, next})
+	w.Write(b)
+}
+
+//校验审计链，broken为第一条被篡改的记录序号。按页读取，不会一次加载整个表；
+//since不为0时从seq为since的记录之后开始校验，limit限制校验的条数，0表示校验到末尾
+func handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	if school == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+	max, _ := strconv.Atoi(r.FormValue("limit"))
+
+	prev := auditEntry{}
+	if since > 0 {
+		entries, err := dbClient.queryAudit(school.name, "", 0, 0, since-1, 1)
+		if err != nil || len(entries) == 0 || entries[0].Seq != since {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		prev = entries[0]
+	}
+
+	checked, broken := 0, int64(0)
+	for broken == 0 && (max <= 0 || checked < max) {
+		limit := auditMaxPage
+		if max > 0 && max-checked < limit {
+			limit = max - checked
+		}
+		entries, err := dbClient.queryAudit(school.name, "", 0, 0, prev.Seq, limit)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(entries) == 0 {
+			break
+		}
+		broken = verifyAudit(prev, entries)
+		checked += len(entries)
+		prev = entries[len(entries)-1]
+	}
+	b, _ := json.Marshal(&struct {
+		Entries int   `json:"entries"`
+		Last    int64 `json:"last"` //最后一条校验的记录序号
+		Broken  int64 `json:"broken"`
+	}{checked, prev.Seq, broken})
+	w.Write(b)
+}
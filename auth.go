@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//登录成功后签发的令牌，格式为：学号:过期时间:签名，签名包含学校名称，
+//修改个人资料等需要确认身份的接口通过请求头Authorization: Bearer <令牌>验证
+var tokenSecret []byte
+
+//没有配置secret时每次启动随机生成，重启后需要重新登录，
+//多个实例同时服务时必须配置相同的secret
+func initTokenSecret() {
+	if config.Secret != "" {
+		tokenSecret = []byte(config.Secret)
+		return
+	}
+	tokenSecret = make([]byte, 32)
+	rand.Read(tokenSecret)
+}
+
+func tokenTtl() time.Duration {
+	if config.TokenTtl <= 0 {
+		return 12 * time.Hour
+	}
+	return time.Duration(config.TokenTtl) * time.Hour
+}
+
+func tokenSignature(school, student string, expiry int64) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", school, student, expiry)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *school) issueToken(student string) string {
+	expiry := time.Now().Add(tokenTtl()).Unix()
+	return fmt.Sprintf("%s:%d:%s", student, expiry, tokenSignature(s.name, student, expiry))
+}
+
+//返回令牌对应的学号，令牌无效或已过期时返回空字符串
+func (s *school) verifyToken(token string) string {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return ""
+	}
+	j := strings.LastIndex(token[:i], ":")
+	if j <= 0 {
+		return ""
+	}
+	student, signature := token[:j], token[i+1:]
+	expiry, err := strconv.ParseInt(token[j+1:i], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return ""
+	}
+	expected := tokenSignature(s.name, student, expiry)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ""
+	}
+	return student
+}
+
+//请求者是否可以修改student的资料：学生本人、学生的家长或管理员
+func (s *school) authorized(r *http.Request, student string) bool {
+	if isAdmin(r) {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" && s.verifyToken(token) == student {
+		return true
+	}
+	p := s.requestParent(r)
+	return p != nil && p.linked(student)
+}
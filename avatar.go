@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+type AvatarConfig struct {
+	MaxSize   int   `yaml:"max_size"`   //上传文件的最大KB数，默认2048
+	MaxPixels int   `yaml:"max_pixels"` //图片的最大宽度或高度，默认4096
+	Sizes     []int `yaml:"sizes"`      //生成的正方形缩略图边长，第一个为资料中的头像，默认[256, 64]
+}
+
+func (self AvatarConfig) withDefaults() AvatarConfig {
+	if self.MaxSize <= 0 {
+		self.MaxSize = 2048
+	}
+	if self.MaxPixels <= 0 {
+		self.MaxPixels = 4096
+	}
+	if len(self.Sizes) == 0 {
+		self.Sizes = []int{256, 64}
+	}
+	return self
+}
+
+//学校名称和学号会成为头像文件的路径，只允许字母、数字、下划线和减号
+var safeName = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+
+//检查上传的文件确实是JPEG或PNG图片，并且尺寸不超过限制
+func decodeAvatar(b []byte, maxPixels int) (image.Image, string) {
+	switch http.DetectContentType(b) {
+	case "image/jpeg", "image/png":
+	default:
+		return nil, "只能上传JPEG或PNG图片"
+	}
+
+	//先只读取尺寸，避免解码尺寸过大的图片占用大量内存
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, "图片格式错误"
+	}
+	if cfg.Width > maxPixels || cfg.Height > maxPixels {
+		return nil, fmt.Sprintf("图片宽度和高度不能超过%d像素", maxPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "图片格式错误"
+	}
+	return img, ""
+}
+
+//把图片居中裁剪成正方形并缩放为size×size，透明部分填充白色。
+//缩小时取对应区域内像素的平均值，放大时取最近的像素
+func thumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	square := image.Rect(0, 0, side, side)
+	flat := image.NewRGBA(square)
+	draw.Draw(flat, square, image.White, image.Point{}, draw.Src)
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	draw.Draw(flat, square, src, offset, draw.Over)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	span := func(i int) (int, int) {
+		start, end := i*side/size, (i+1)*side/size
+		if end == start {
+			end = start + 1
+		}
+		return start, end
+	}
+	for y := 0; y < size; y++ {
+		y0, y1 := span(y)
+		for x := 0; x < size; x++ {
+			x0, x1 := span(x)
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				i := flat.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(flat.Pix[i])
+					g += int(flat.Pix[i+1])
+					b += int(flat.Pix[i+2])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] =
+				uint8(r/n), uint8(g/n), uint8(b/n), 255
+		}
+	}
+	return dst
+}
+
+//先写入临时文件再改名，读取头像的请求不会读到写了一半的文件
+func writeJpeg(path string, img image.Image) error {
+	buf := bytes.Buffer{}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//每个学生的头像保存在单独的目录中，文件名包含上传时间，更新头像后浏览器不会
+//继续使用缓存的旧头像。重新编码后的图片不包含EXIF等元数据。返回资料中的头像路径
+func (s *school) saveAvatar(student string, img image.Image, sizes []int) (string, error) {
+	dir := filepath.Join(config.Avatar, s.name, student)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	old, _ := filepath.Glob(filepath.Join(dir, "*.jpg"))
+
+	version := time.Now().UnixNano() / int64(time.Millisecond)
+	avatar := ""
+	for i, size := range sizes {
+		name := fmt.Sprintf("%d-%d.jpg", version, size)
+		if i == 0 {
+			name = fmt.Sprintf("%d.jpg", version)
+			avatar = s.name + "/" + student + "/" + name
+		}
+		err = writeJpeg(filepath.Join(dir, name), thumbnail(img, size))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = dbClient.updateAvatar(s.name, student, avatar)
+	if err != nil {
+		return "", err
+	}
+	s.forgetProfile(student)
+	//目录中只有本学生的头像，写入数据库后删除之前的版本
+	for _, v := range old {
+		os.Remove(v)
+	}
+	return avatar, nil
+}
+
+//请求体为图片文件，或者multipart/form-data表单中的第一个文件
+func readAvatar(r *http.Request, body io.Reader) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return ioutil.ReadAll(body)
+	}
+
+	r.Body = ioutil.NopCloser(body)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil //没有文件，按不是图片处理
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FileName() != "" {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
+
+//上传头像，学校和学号在URL参数中，请求体为图片文件或包含图片的表单。
+//需要学生本人的登录令牌或管理员令牌
+func handleAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 2 || r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("school")
+	student := r.FormValue("student")
+	if !safeName.MatchString(name) || !safeName.MatchString(student) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(name)
+	if !school.authorized(r, student) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	cfg := config.AvatarUpload.withDefaults()
+	b, err := readAvatar(r, http.MaxBytesReader(w, r.Body, int64(cfg.MaxSize)*1024))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	errCode := 1
+	errMsg := "上传失败"
+	avatar := ""
+	img, msg := decodeAvatar(b, cfg.MaxPixels)
+	if msg != "" {
+		errMsg = msg
+	} else if avatar, err = school.saveAvatar(student, img, cfg.Sizes); err == errNotFound {
+		errMsg = "没有学生资料"
+	} else if err != nil {
+		log.Println("avatar:", err)
+	} else {
+		errCode = 0
+		errMsg = "上传成功"
+	}
+
+	actor, _ := school.actor(r, student)
+	school.audit(auditEntry{Action: auditAvatar, Actor: actor, Student: student,
+		Result: errMsg, Detail: avatar, IP: clientIP(r)})
+
+	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s","avatar":"%s"}`,
+		errCode, errMsg, signAvatar(avatar))))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -12,7 +14,13 @@ import (
 
 const prompt = `1. 设置模块课报名开始时间
 2. 设置拓展课报名开始时间
-3. 退出`
+3. 退出
+4. 取消报名开始时间
+5. 管理员报名
+6. 管理员退课
+7. 查看写入数据库失败的数据
+8. 重新写入数据库失败的数据
+9. 导入学生名册`
 
 type CLIHandler interface {
 	Handle() int
@@ -56,10 +64,16 @@ func formatTime(seconds int64) string {
 
 var tHandlers = map[THandler]interface{}{} //把map当成list用
 var mutexTimers sync.Mutex
+var timersStopped bool        //退出时停止定时器，由mutexTimers保护
+var timerTasks sync.WaitGroup //定时器启动的协程，例如抽签和同步名额
 
 func IntervalHandler() {
 	deletingHandlers := make([]THandler, 0)
 	mutexTimers.Lock()
+	if timersStopped {
+		mutexTimers.Unlock()
+		return
+	}
 	for h := range tHandlers {
 		if h.handle() == Quit() {
 			deletingHandlers = append(deletingHandlers, h)
@@ -74,6 +88,14 @@ func IntervalHandler() {
 	time.AfterFunc(time.Second, IntervalHandler)
 }
 
+//停止定时器，等待正在执行的定时器和它们启动的协程结束
+func stopTimers() {
+	mutexTimers.Lock()
+	timersStopped = true
+	mutexTimers.Unlock()
+	timerTasks.Wait()
+}
+
 func RegisterTHandler(handler THandler) {
 	mutexTimers.Lock()
 	tHandlers[handler] = nil
@@ -100,7 +122,7 @@ func (self *CourseStartHandler) handle() int {
 
 	if self.seconds <= 0 {
 		ColorGreen(fmt.Sprintf("\n%s报名已开始...", self.name))
-		self.s.started = true
+		self.s.start()
 		return Quit()
 	}
 
@@ -157,6 +179,7 @@ func SetStartTime(s *school, name, table string) {
 	}
 
 	ColorRed(fmt.Sprintf("设置成功：%s报名将在 %s 后开始\n", name, formatTime(seconds)))
+	s.auditConsole(auditTimerSet, fmt.Sprintf("%s %s", name, input))
 
 	//如果离报名开始的时间小于sToLoad则立刻加载课程
 	const sToLoad = 300 //默认5分钟
@@ -168,6 +191,32 @@ func SetStartTime(s *school, name, table string) {
 	return
 }
 
+func cancelTimer(s *school, name string) bool {
+	found := false
+	mutexTimers.Lock()
+	for k := range tHandlers {
+		if c, ok := k.(*CourseStartHandler); ok && c.s == s && c.name == name {
+			delete(tHandlers, k)
+			found = true
+		}
+	}
+	mutexTimers.Unlock()
+	return found
+}
+
+func CancelStartTime(s *school) {
+
+	fmt.Print("输入要取消的课程类别<eg. 模块课>: ")
+	input := ziphttp.ReadInput()
+	if !cancelTimer(s, input) {
+		ColorRed("取消失败：没有找到该课程类别的报名开始时间")
+		return
+	}
+
+	ColorRed(fmt.Sprintf("取消成功：%s报名开始时间已取消\n", input))
+	s.auditConsole(auditTimerCancel, input)
+}
+
 func course01() {
 	s := getSchool("mbxsj")
 	SetStartTime(s, "模块课", "course")
@@ -178,6 +227,97 @@ func course02() {
 	SetStartTime(s, "拓展课", "course02")
 }
 
+func cancelCourse() {
+	s := getSchool("mbxsj")
+	CancelStartTime(s)
+}
+
+func AdminOverride(s *school, action string) {
+
+	fmt.Print("输入学号: ")
+	student := ziphttp.ReadInput()
+	fmt.Print("输入课程名称: ")
+	course := ziphttp.ReadInput()
+	fmt.Print("输入原因: ")
+	reason := ziphttp.ReadInput()
+	if student == "" || course == "" || reason == "" {
+		ColorRed("操作失败：学号、课程名称和原因不能为空")
+		return
+	}
+	force := false
+	if action == auditAdminEnroll {
+		fmt.Print("是否忽略报名时间、名额和选课规则<y/n>: ")
+		force = ziphttp.ReadInput() == "y"
+	}
+
+	errCode, errMsg := s.adminOverride(auditEntry{Action: action, Actor: actorConsole,
+		Student: student, Course: course, Detail: overrideDetail(reason, force)}, force)
+	if errCode != 0 {
+		ColorRed("操作失败：" + errMsg)
+		return
+	}
+	ColorRed(fmt.Sprintf("操作成功：%s %s %s\n", student, course, errMsg))
+}
+
+func adminEnroll() {
+	s := getSchool("mbxsj")
+	AdminOverride(s, auditAdminEnroll)
+}
+
+func adminDrop() {
+	s := getSchool("mbxsj")
+	AdminOverride(s, auditAdminDrop)
+}
+
+func listDeadLetters() {
+	letters, err := deadLetters.list()
+	if err != nil {
+		ColorRed("读取失败：" + err.Error())
+		return
+	}
+	for _, v := range letters {
+		b, _ := json.Marshal(&v)
+		fmt.Println(string(b))
+	}
+	ColorRed(fmt.Sprintf("共%d条\n", len(letters)))
+}
+
+func replayDeadLetters() {
+	replayed, failed, err := deadLetters.replay()
+	if err != nil {
+		ColorRed("重新写入失败：" + err.Error())
+		return
+	}
+	ColorRed(fmt.Sprintf("已写入%d条，%d条仍然失败\n", replayed, failed))
+}
+
+func importRoster() {
+	s := getSchool("mbxsj")
+	fmt.Print("输入名册文件路径（csv：学号,姓名,年级,班级,状态）: ")
+	f, err := os.Open(ziphttp.ReadInput())
+	if err != nil {
+		ColorRed("导入失败：" + err.Error())
+		return
+	}
+	defer f.Close()
+	entries, err := parseRoster(f)
+	if err != nil {
+		ColorRed("导入失败：" + err.Error())
+		return
+	}
+	fmt.Print("文件中没有的学生是否改为inactive<y/n>: ")
+	replace := ziphttp.ReadInput() == "y"
+
+	n, err := s.importRoster(entries, replace)
+	result := fmt.Sprintf("已导入%d条", n)
+	if err != nil {
+		result = "导入失败：" + err.Error()
+	}
+	s.audit(auditEntry{Action: auditRoster, Actor: actorConsole, Result: result,
+		Detail: fmt.Sprintf("import replace=%t", replace)})
+	ColorRed(result + "\n")
+}
+
 func test() {
 	s := getSchool("mbxsj")
 	h := &CourseStartHandler{s, "拓展课", "course02", 1, 0}
@@ -188,5 +328,11 @@ var CmdLineHandler = map[string]CLIHandler{
 	"1":    CLIContinue(course01),
 	"2":    CLIContinue(course02),
 	"3":    CLIQuit(),
+	"4":    CLIContinue(cancelCourse),
+	"5":    CLIContinue(adminEnroll),
+	"6":    CLIContinue(adminDrop),
+	"7":    CLIContinue(listDeadLetters),
+	"8":    CLIContinue(replayDeadLetters),
+	"9":    CLIContinue(importRoster),
 	"test": CLIContinue(test),
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//管理后台显示的最近事件条数
+const recentEventCount = 200
+
+type recentEvent struct {
+	School string `json:"school"`
+	auditEntry
+}
+
+//所有学校最近的审计事件，环形缓冲区，只保存在内存中
+type eventRing struct {
+	m      sync.Mutex
+	events [recentEventCount]recentEvent
+	next   int
+	count  int
+}
+
+var recentEvents = &eventRing{}
+
+func (self *eventRing) add(school string, e auditEntry) {
+	self.m.Lock()
+	self.events[self.next] = recentEvent{school, e}
+	self.next = (self.next + 1) % recentEventCount
+	if self.count < recentEventCount {
+		self.count += 1
+	}
+	self.m.Unlock()
+}
+
+//最新的在前
+func (self *eventRing) list() []recentEvent {
+	self.m.Lock()
+	defer self.m.Unlock()
+	events := make([]recentEvent, 0, self.count)
+	for i := 1; i <= self.count; i++ {
+		events = append(events, self.events[(self.next-i+recentEventCount)%recentEventCount])
+	}
+	return events
+}
+
+type dashboardTimer struct {
+	Kind    string `json:"kind"` //start：报名开始，close：抽签或志愿填报截止
+	Name    string `json:"name"`
+	Seconds int64  `json:"seconds"`
+}
+
+type dashboardCourse struct {
+	Name    string `json:"name"`
+	Teacher string `json:"teacher"`
+	Total   int    `json:"total"`
+	Number  int    `json:"number"`
+}
+
+type dashboardSchool struct {
+	Name      string            `json:"name"`
+	CourseTag string            `json:"courseTag"`
+	Mode      string            `json:"mode"`
+	Started   bool              `json:"started"`
+	Closed    bool              `json:"closed"`
+	Timers    []dashboardTimer  `json:"timers"`
+	Courses   []dashboardCourse `json:"courses"`
+}
+
+func (s *school) dashboard() dashboardSchool {
+	d := dashboardSchool{Name: s.name, Timers: []dashboardTimer{},
+		Courses: []dashboardCourse{}}
+	s.m.RLock()
+	d.CourseTag, d.Mode, d.Started, d.Closed = s.courseTag, s.mode, s.started, s.closed
+	for _, v := range s.courses {
+		v.m.Lock()
+		d.Courses = append(d.Courses, dashboardCourse{v.c.Name, v.c.Teacher, v.c.Total, v.c.Number})
+		v.m.Unlock()
+	}
+	s.m.RUnlock()
+	return d
+}
+
+//各学校的报名状态、定时器、课程人数、最近事件、写入队列和数据库错误计数
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	mutexSchool.RLock()
+	list := make([]*school, 0, len(schools))
+	for _, v := range schools {
+		list = append(list, v)
+	}
+	mutexSchool.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	bySchool := map[*school]*dashboardSchool{}
+	result := struct {
+		Schools  []*dashboardSchool `json:"schools"`
+		Events   []recentEvent      `json:"events"`
+		Pending  int64              `json:"pending"` //等待写入数据库的条数
+		Channels []int              `json:"channels"`
+		Handled  int64              `json:"handled"`
+		Retries  int64              `json:"retries"` //写入数据库失败后重试的次数
+		Failed   int64              `json:"failed"`  //重试后仍失败、转入死信队列的条数
+		Database healthCheck        `json:"database"`
+	}{Schools: []*dashboardSchool{}, Channels: []int{}}
+	for _, v := range list {
+		d := v.dashboard()
+		bySchool[v] = &d
+		result.Schools = append(result.Schools, &d)
+	}
+
+	mutexTimers.Lock()
+	for k := range tHandlers {
+		switch h := k.(type) {
+		case *CourseStartHandler:
+			if d, ok := bySchool[h.s]; ok {
+				d.Timers = append(d.Timers, dashboardTimer{"start", h.name, h.seconds})
+			}
+		case *LotteryCloseHandler:
+			if d, ok := bySchool[h.s]; ok {
+				d.Timers = append(d.Timers, dashboardTimer{"close", h.name, h.seconds})
+			}
+		}
+	}
+	mutexTimers.Unlock()
+
+	result.Events = recentEvents.list()
+	result.Pending = atomic.LoadInt64(&dbPending)
+	for _, v := range dbChannels {
+		result.Channels = append(result.Channels, len(v))
+	}
+	result.Handled = atomic.LoadInt64(&dbHandled)
+	result.Retries = atomic.LoadInt64(&dbRetries)
+	result.Failed = atomic.LoadInt64(&dbFailed)
+	result.Database = checkDatabase()
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(&result)
+	w.Write(b)
+}
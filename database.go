@@ -18,13 +18,29 @@ import (
 
 type database interface {
 	init(string) error
+	ping() error
 	loadCourses(string, string) ([]*courseObj, error)
 	registerCourse(string, string, string, string, int64) error
+	registerCourses(string, []registerData, bool) (int, error)
 	unRegisterCourse(string, string, string) error
 	getRegisterHistory(string, string) ([]byte, error)
-	getStudentProfile(string, string) (string, string, error)
+	getStudentProfile(string, string) (profile, error)
+	updateAvatar(string, string, string) error
+	getParent(string, string, string) (parent, error)
+	loadRoster(string) ([]rosterEntry, error)
+	saveRoster(string, []rosterEntry) error
+	saveLotteryDraw(string, *lotteryDraw) error
+	saveAllocationReport(string, *allocationReport) error
+	appendAudits(string, []auditEntry, bool) (int, error)
+	lastAuditEntry(string) (auditEntry, error)
+	queryAudit(string, string, int64, int64, int64, int) ([]auditEntry, error)
+	reserveSeat(string, string, course, string, studentInfo, bool, func([]string) string) (string, error)
+	releaseSeat(string, string, course, string, studentInfo) error
+	loadSeats(string, string) (map[string]seatCount, error)
 }
 
+var errNotFound = errors.New("not found")
+
 type MongoDb struct {
 	dbClient *mongo.Client
 }
@@ -50,6 +66,12 @@ func (self *MongoDb) init(ds string) (err error) {
 	return nil
 }
 
+func (self *MongoDb) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return self.dbClient.Ping(ctx, nil)
+}
+
 func (self *MongoDb) loadCourses(dbName, table string) ([]*courseObj, error) {
 
 	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
@@ -68,8 +90,7 @@ func (self *MongoDb) loadCourses(dbName, table string) ([]*courseObj, error) {
 			log.Println(err)
 			return nil, err
 		}
-		courses = append(courses,
-			NewCourseObj(result.Name, result.Teacher, result.Total, result.Grade))
+		courses = append(courses, NewCourseObj(result))
 	}
 
 	return courses, nil
@@ -89,6 +110,39 @@ func (self *MongoDb) registerCourse(dbName, student, course, teacher string,
 	return err
 }
 
+//返回从头开始已经写入的条数。InsertMany不是事务，失败时不知道写入了多少条，
+//所以retry为true时按学号、课程和时间逐条upsert，已经写入的不会重复
+func (self *MongoDb) registerCourses(dbName string, data []registerData,
+	retry bool) (int, error) {
+
+	docs := make([]interface{}, len(data))
+	for i, v := range data {
+		docs[i] = bson.M{
+			"student":   v.Student,
+			"course":    v.Course,
+			"teacher":   v.Teacher,
+			"timestamp": v.TimeStamp,
+		}
+	}
+	collection := self.dbClient.Database(dbName).Collection("register-info")
+	if !retry {
+		_, err := collection.InsertMany(nil, docs, options.InsertMany().SetOrdered(true))
+		if err != nil {
+			return 0, err
+		}
+		return len(docs), nil
+	}
+	for i, v := range data {
+		_, err := collection.UpdateOne(nil,
+			bson.M{"student": v.Student, "course": v.Course, "timestamp": v.TimeStamp},
+			bson.M{"$setOnInsert": docs[i]}, options.Update().SetUpsert(true))
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
 func (self *MongoDb) unRegisterCourse(dbName, student, course string) error {
 
 	collection := self.dbClient.Database(dbName).Collection("register-info")
@@ -137,26 +191,349 @@ func (self *MongoDb) getRegisterHistory(dbName, student string) ([]byte, error)
 	return json.Marshal(registerHistory)
 }
 
-func (self *MongoDb) getStudentProfile(dbName, student string) (string, string, error) {
-
-	profile := struct {
-		Name   string `json:"name"`
-		Avatar string `json:"avatar"`
-	}{}
+func (self *MongoDb) getStudentProfile(dbName, student string) (profile, error) {
 
+	result := profile{}
 	collection := self.dbClient.Database(dbName).Collection("profile")
 	cur, err := collection.Find(nil, bson.M{"student": student})
 	if err != nil {
-		return "", "", err
+		return result, err
+	}
+
+	defer cur.Close(nil)
+	if !cur.Next(nil) {
+		err = errNotFound
+	} else {
+		cur.Decode(&result)
+	}
+	return result, err
+}
+
+//只修改已有的学生资料，没有资料时返回errNotFound
+func (self *MongoDb) updateAvatar(dbName, student, avatar string) error {
+	collection := self.dbClient.Database(dbName).Collection("profile")
+	result, err := collection.UpdateOne(nil, bson.M{"student": student},
+		bson.M{"$set": bson.M{"avatar": avatar}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+//按家长编号（field为parent）或微信openid（field为openid）查找家长
+func (self *MongoDb) getParent(dbName, field, value string) (parent, error) {
+	result := parent{}
+	collection := self.dbClient.Database(dbName).Collection("parent")
+	cur, err := collection.Find(nil, bson.M{field: value})
+	if err != nil {
+		return result, err
 	}
 
 	defer cur.Close(nil)
 	if !cur.Next(nil) {
-		err = errors.New("not found")
+		err = errNotFound
 	} else {
-		cur.Decode(&profile)
+		cur.Decode(&result)
+	}
+	return result, err
+}
+
+func (self *MongoDb) loadRoster(dbName string) ([]rosterEntry, error) {
+	collection := self.dbClient.Database(dbName).Collection("roster")
+	cur, err := collection.Find(nil, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close(nil)
+	entries := []rosterEntry{}
+	for cur.Next(nil) {
+		e := rosterEntry{}
+		if err := cur.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//按学号新增或覆盖名册中的学生
+func (self *MongoDb) saveRoster(dbName string, entries []rosterEntry) error {
+	collection := self.dbClient.Database(dbName).Collection("roster")
+	for _, v := range entries {
+		_, err := collection.UpdateOne(nil, bson.M{"student": v.Student},
+			bson.M{"$set": bson.M{"name": v.Name, "grade": v.Grade, "class": v.Class,
+				"status": v.Status}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *MongoDb) saveLotteryDraw(dbName string, draw *lotteryDraw) error {
+
+	collection := self.dbClient.Database(dbName).Collection("lottery")
+	_, err := collection.InsertOne(nil, draw)
+	return err
+}
+
+func (self *MongoDb) saveAllocationReport(dbName string, report *allocationReport) error {
+
+	collection := self.dbClient.Database(dbName).Collection("allocation")
+	_, err := collection.InsertOne(nil, report)
+	return err
+}
+
+//与registerCourses相同，retry为true时按seq逐条upsert，seq重复会使校验失败
+func (self *MongoDb) appendAudits(dbName string, entries []auditEntry,
+	retry bool) (int, error) {
+
+	docs := make([]interface{}, len(entries))
+	for i, v := range entries {
+		docs[i] = v
+	}
+	collection := self.dbClient.Database(dbName).Collection("audit")
+	if !retry {
+		_, err := collection.InsertMany(nil, docs, options.InsertMany().SetOrdered(true))
+		if err != nil {
+			return 0, err
+		}
+		return len(docs), nil
+	}
+	for i, v := range entries {
+		_, err := collection.UpdateOne(nil, bson.M{"seq": v.Seq},
+			bson.M{"$setOnInsert": docs[i]}, options.Update().SetUpsert(true))
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
+func (self *MongoDb) lastAuditEntry(dbName string) (auditEntry, error) {
+
+	result := auditEntry{}
+	collection := self.dbClient.Database(dbName).Collection("audit")
+	cur, err := collection.Find(nil, bson.M{},
+		options.Find().SetSort(bson.M{"seq": -1}).SetLimit(1))
+	if err != nil {
+		return result, err
+	}
+
+	defer cur.Close(nil)
+	if !cur.Next(nil) {
+		return result, errNotFound
+	}
+	err = cur.Decode(&result)
+	return result, err
+}
+
+//按seq顺序返回seq大于since的最多limit条记录
+func (self *MongoDb) queryAudit(dbName, student string, from, to, since int64,
+	limit int) ([]auditEntry, error) {
+
+	filter := bson.M{"seq": bson.M{"$gt": since}}
+	if student != "" {
+		filter["student"] = student
+	}
+	timestamp := bson.M{}
+	if from > 0 {
+		timestamp["$gte"] = from
+	}
+	if to > 0 {
+		timestamp["$lte"] = to
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	collection := self.dbClient.Database(dbName).Collection("audit")
+	cur, err := collection.Find(nil, filter,
+		options.Find().SetSort(bson.M{"seq": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close(nil)
+	entries := []auditEntry{}
+	for cur.Next(nil) {
+		result := auditEntry{}
+		err = cur.Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, result)
+	}
+	return entries, nil
+}
+
+//学生占用的名额在seat-holders中每个学生一条记录，_id为课程表/学号，由数据库保证唯一。
+//课程名单用version乐观锁修改，同一学生在多个实例同时报名时只有一个能修改成功，
+//check按修改前的名单检查重复报名和选课规则
+func (self *MongoDb) holdSeat(dbName, table, student, course string,
+	check func([]string) string) (string, error) {
+
+	collection := self.dbClient.Database(dbName).Collection("seat-holders")
+	id := table + "/" + student
+	for i := 0; i < 5; i++ {
+		holder := struct {
+			Courses []string
+			Version int64
+		}{}
+		cur, err := collection.Find(nil, bson.M{"_id": id}, options.Find().SetLimit(1))
+		if err != nil {
+			return "", err
+		}
+		if cur.Next(nil) {
+			err = cur.Decode(&holder)
+		}
+		cur.Close(nil)
+		if err != nil {
+			return "", err
+		}
+		if msg := check(holder.Courses); msg != "" {
+			return msg, nil
+		}
+
+		//version为0时还没有记录，两个实例同时插入时_id重复的一方重新读取
+		result, err := collection.UpdateOne(nil, bson.M{"_id": id, "version": holder.Version},
+			bson.M{"$push": bson.M{"courses": course}, "$inc": bson.M{"version": 1}},
+			options.Update().SetUpsert(holder.Version == 0))
+		if err == nil && (result.MatchedCount > 0 || result.UpsertedID != nil) {
+			return "", nil
+		}
+		if err != nil && holder.Version != 0 {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("seat holder %s: too many concurrent updates", id)
+}
+
+func (self *MongoDb) unholdSeat(dbName, table, student, course string) error {
+	collection := self.dbClient.Database(dbName).Collection("seat-holders")
+	_, err := collection.UpdateOne(nil, bson.M{"_id": table + "/" + student},
+		bson.M{"$pull": bson.M{"courses": course}, "$inc": bson.M{"version": 1}})
+	return err
+}
+
+//先在seat-holders中占用，再在课程文档上用一次findOneAndUpdate同时检查并增加
+//总人数、年级和班级人数，名额已满时撤销占用并返回已满的原因
+func (self *MongoDb) reserveSeat(dbName, table string, c course, student string,
+	info studentInfo, force bool, check func([]string) string) (string, error) {
+
+	msg, err := self.holdSeat(dbName, table, student, c.Name, check)
+	if msg != "" || err != nil {
+		return msg, err
+	}
+
+	grade := fmt.Sprintf("gradecount.%d", info.Grade)
+	class := "classcount." + info.classKey()
+	filter := bson.M{"name": c.Name}
+	inc := bson.M{"number": 1, grade: 1}
+	if info.Class != "" {
+		inc[class] = 1
+	}
+	if !force {
+		filter["$expr"] = bson.M{"$lt": bson.A{"$number", "$total"}}
+		if max, ok := c.gradeQuota(info.Grade); ok {
+			filter[grade] = bson.M{"$not": bson.M{"$gte": max}}
+		}
+		if c.ClassQuota > 0 && info.Class != "" {
+			filter[class] = bson.M{"$not": bson.M{"$gte": c.ClassQuota}}
+		}
+	}
+
+	collection := self.dbClient.Database(dbName).Collection(table)
+	err = collection.FindOneAndUpdate(nil, filter, bson.M{"$inc": inc}).Err()
+	if err == nil {
+		return "", nil
+	}
+	if e := self.unholdSeat(dbName, table, student, c.Name); e != nil {
+		log.Println("unhold seat:", e)
+	}
+	if err != mongo.ErrNoDocuments {
+		return "", err
+	}
+
+	cur, err := collection.Find(nil, bson.M{"name": c.Name}, options.Find().SetLimit(1))
+	if err != nil {
+		return "", err
 	}
-	return profile.Name, profile.Avatar, err
+	defer cur.Close(nil)
+	n := newSeatCount()
+	if cur.Next(nil) {
+		result := mongoSeatCount{}
+		if err = cur.Decode(&result); err != nil {
+			return "", err
+		}
+		n = result.seatCount()
+	}
+	return seatsFull(c, n, info), nil
+}
+
+func (self *MongoDb) releaseSeat(dbName, table string, c course, student string,
+	info studentInfo) error {
+
+	inc := bson.M{"number": -1, fmt.Sprintf("gradecount.%d", info.Grade): -1}
+	if info.Class != "" {
+		inc["classcount."+info.classKey()] = -1
+	}
+
+	collection := self.dbClient.Database(dbName).Collection(table)
+	_, err := collection.UpdateOne(nil,
+		bson.M{"name": c.Name, "number": bson.M{"$gt": 0}}, bson.M{"$inc": inc})
+	if err != nil {
+		return err
+	}
+	return self.unholdSeat(dbName, table, student, c.Name)
+}
+
+//课程文档中的人数，年级人数的键为字符串
+type mongoSeatCount struct {
+	Name       string
+	Number     int
+	GradeCount map[string]int
+	ClassCount map[string]int
+}
+
+func (self mongoSeatCount) seatCount() seatCount {
+	n := newSeatCount()
+	n.Number = self.Number
+	for k, v := range self.GradeCount {
+		if grade, err := strconv.Atoi(k); err == nil {
+			n.Grades[grade] = v
+		}
+	}
+	for k, v := range self.ClassCount {
+		n.Classes[k] = v
+	}
+	return n
+}
+
+func (self *MongoDb) loadSeats(dbName, table string) (map[string]seatCount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	collection := self.dbClient.Database(dbName).Collection(table)
+	cur, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close(ctx)
+	counts := map[string]seatCount{}
+	for cur.Next(ctx) {
+		result := mongoSeatCount{}
+		err := cur.Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+		counts[result.Name] = result.seatCount()
+	}
+	return counts, cur.Err()
 }
 
 func (self *SqlDb) init(ds string) (err error) {
@@ -182,6 +559,12 @@ func (self *SqlDb) init(ds string) (err error) {
 	return nil
 }
 
+func (self *SqlDb) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return self.dbClient.PingContext(ctx)
+}
+
 func parseGrade(grade string) []int {
 	s := strings.Split(grade, ",")
 	if len(s) == 0 {
@@ -196,6 +579,46 @@ func parseGrade(grade string) []int {
 	return g
 }
 
+//课程表的前4列依次为名称、教师、人数、年级，之后的可选列按列名读取，
+//这样旧的课程表不需要修改也能继续使用
+func scanCourse(rows *sql.Rows, columns []string) (course, error) {
+	result := course{}
+	grade := ""
+	group := sql.NullString{}
+	schedule := sql.NullString{}
+	gradeQuota := sql.NullString{}
+	classQuota := sql.NullInt64{}
+	optional := map[string]interface{}{
+		"group":      &group,
+		"schedule":   &schedule,
+		"gradequota": &gradeQuota,
+		"classquota": &classQuota,
+	}
+
+	dest := []interface{}{&result.Name, &result.Teacher, &result.Total, &grade}
+	for i := len(dest); i < len(columns); i++ {
+		if v, ok := optional[strings.ToLower(columns[i])]; ok {
+			dest = append(dest, v)
+		} else {
+			dest = append(dest, new(interface{}))
+		}
+	}
+
+	err := rows.Scan(dest...)
+	if err != nil {
+		return result, err
+	}
+	result.Grade = parseGrade(grade)
+	result.Group = group.String
+	result.ClassQuota = int(classQuota.Int64)
+	result.Schedule, err = parseSchedule(schedule.String)
+	if err != nil {
+		return result, err
+	}
+	result.GradeQuota, err = parseGradeQuota(gradeQuota.String)
+	return result, err
+}
+
 func (self *SqlDb) loadCourses(dbName, table string) ([]*courseObj, error) {
 	ctx := context.Background()
 	sqlString := fmt.Sprintf("SELECT * FROM %s", table)
@@ -208,17 +631,19 @@ func (self *SqlDb) loadCourses(dbName, table string) ([]*courseObj, error) {
 
 	defer rows.Close()
 	courses := make([]*courseObj, 0)
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 	for rows.Next() {
-		result := course{}
-		grade := ""
-		err := rows.Scan(&result.Name, &result.Teacher, &result.Total, &grade)
+		result, err := scanCourse(rows, columns)
 		if err != nil {
 			log.Println(err)
 			return nil, err
 		}
 
-		courses = append(courses,
-			NewCourseObj(result.Name, result.Teacher, result.Total, parseGrade(grade)))
+		courses = append(courses, NewCourseObj(result))
 	}
 
 	return courses, nil
@@ -237,6 +662,94 @@ func (self *SqlDb) registerCourse(dbName, student, course, teacher string,
 	return err
 }
 
+//sql server每条语句最多2100个参数，按此拆分成多条INSERT在一个事务中执行
+func (self *SqlDb) insertRows(table string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	const maxParams = 2000
+	perStatement := maxParams / len(rows[0])
+
+	tx, err := self.dbClient.Begin()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(rows); start += perStatement {
+		end := start + perStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(rows[0]))
+		for _, row := range rows[start:end] {
+			params := make([]string, len(row))
+			for i := range row {
+				params[i] = fmt.Sprintf("@p%d", len(args)+i+1)
+			}
+			values = append(values, "("+strings.Join(params, ", ")+")")
+			args = append(args, row...)
+		}
+
+		_, err = tx.Exec("INSERT INTO "+table+" VALUES "+strings.Join(values, ", "), args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//重试时使用，提交的结果不确定时事务可能已经写入。逐条写入，key中的列与已有记录
+//全部相同时跳过，返回从头开始已经写入的条数
+func (self *SqlDb) insertRowsOnce(table string, columns []string, key []int,
+	rows [][]interface{}) (int, error) {
+
+	for i, row := range rows {
+		conditions := make([]string, len(key))
+		for j, k := range key {
+			conditions[j] = fmt.Sprintf("%s=@p%d", columns[k], k+1)
+		}
+		params := make([]string, len(row))
+		for j := range row {
+			params[j] = fmt.Sprintf("@p%d", j+1)
+		}
+		_, err := self.dbClient.Exec(fmt.Sprintf(
+			"IF NOT EXISTS (SELECT 1 FROM %s WHERE %s) INSERT INTO %s VALUES (%s)",
+			table, strings.Join(conditions, " AND "), table, strings.Join(params, ", ")),
+			row...)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(rows), nil
+}
+
+var registerColumns = []string{"student", "course", "teacher", "timestamp"}
+
+func (self *SqlDb) registerCourses(dbName string, data []registerData,
+	retry bool) (int, error) {
+
+	rows := make([][]interface{}, len(data))
+	for i, v := range data {
+		rows[i] = []interface{}{v.Student, v.Course, v.Teacher, v.TimeStamp}
+	}
+	if retry {
+		n, err := self.insertRowsOnce("register_info_test", registerColumns,
+			[]int{0, 1, 3}, rows)
+		if err != nil {
+			log.Println(err)
+		}
+		return n, err
+	}
+	err := self.insertRows("register_info_test", rows)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return len(rows), nil
+}
+
 func (self *SqlDb) unRegisterCourse(dbName, student, course string) error {
 	ctx := context.Background()
 	sqlString := fmt.Sprintf(`SELECT TOP 1 timestamp FROM register_info_test WHERE student='%s' AND course='%s' ORDER BY timestamp DESC`,
@@ -251,7 +764,7 @@ func (self *SqlDb) unRegisterCourse(dbName, student, course string) error {
 	defer rows.Close()
 	var timestamp int64
 	if !rows.Next() {
-		err = errors.New("not found")
+		err = errNotFound
 		return err
 	}
 
@@ -299,40 +812,444 @@ func (self *SqlDb) getRegisterHistory(dbName, student string) ([]byte, error) {
 	return json.Marshal(registerHistory)
 }
 
-func (self *SqlDb) getStudentProfile(dbName, student string) (string, string, error) {
+func (self *SqlDb) getStudentProfile(dbName, student string) (profile, error) {
 
 	ctx := context.Background()
-	sqlString := fmt.Sprintf("SELECT name, avatar FROM profile WHERE student='%s'", student)
+	sqlString := fmt.Sprintf("SELECT * FROM profile WHERE student='%s'", student)
 
 	rows, err := self.dbClient.QueryContext(ctx, sqlString)
 	if err != nil {
 		log.Println(err)
-		return "", "", err
+		return profile{}, err
 	}
 
 	defer rows.Close()
 
-	name, avatar := "", ""
+	result := profile{}
 	if !rows.Next() {
-		err = errors.New("not found")
+		err = errNotFound
 	} else {
-		err = rows.Scan(&name, &avatar)
+		name, avatar, grade, class := sql.NullString{}, sql.NullString{},
+			sql.NullInt64{}, sql.NullString{}
+		email, phone, openId := sql.NullString{}, sql.NullString{}, sql.NullString{}
+		err = scanNamed(rows, map[string]interface{}{
+			"name":   &name,
+			"avatar": &avatar,
+			"grade":  &grade,
+			"class":  &class,
+			"email":  &email,
+			"phone":  &phone,
+			"openid": &openId,
+		})
 		if err != nil {
 			log.Println(err)
 		}
+		result = profile{name.String, avatar.String, int(grade.Int64), class.String,
+			email.String, phone.String, openId.String}
 		//avatar = "https://xsj.chneic.sh.cn/avatar/" + avatar
 	}
 
-	return name, avatar, err
+	return result, err
+}
+
+func (self *SqlDb) updateAvatar(dbName, student, avatar string) error {
+	result, err := self.dbClient.Exec(`UPDATE profile SET avatar = @p1 WHERE student = @p2`,
+		avatar, student)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !affected(result) {
+		return errNotFound
+	}
+	return nil
+}
+
+//按列名读取当前行，named中没有的列忽略，表中没有的列保持原值
+func scanNamed(rows *sql.Rows, named map[string]interface{}) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	dest := make([]interface{}, len(columns))
+	for i, c := range columns {
+		if v, ok := named[strings.ToLower(c)]; ok {
+			dest[i] = v
+		} else {
+			dest[i] = new(interface{})
+		}
+	}
+	return rows.Scan(dest...)
+}
+
+//家长与学生的关联保存在parent_student表中
+func (self *SqlDb) getParent(dbName, field, value string) (parent, error) {
+	if field != "parent" && field != "openid" {
+		return parent{}, errNotFound
+	}
+	result := parent{}
+	name, phone, openId := sql.NullString{}, sql.NullString{}, sql.NullString{}
+	err := self.dbClient.QueryRow(`SELECT parent, name, phone, openid FROM parent WHERE `+
+		field+` = @p1`, value).Scan(&result.Parent, &name, &phone, &openId)
+	if err == sql.ErrNoRows {
+		return result, errNotFound
+	}
+	if err != nil {
+		log.Println(err)
+		return result, err
+	}
+	result.Name, result.Phone, result.OpenId = name.String, phone.String, openId.String
+
+	rows, err := self.dbClient.Query(`SELECT student FROM parent_student WHERE parent = @p1`,
+		result.Parent)
+	if err != nil {
+		log.Println(err)
+		return result, err
+	}
+	defer rows.Close()
+	result.Students = []string{}
+	for rows.Next() {
+		student := ""
+		if err = rows.Scan(&student); err != nil {
+			return result, err
+		}
+		result.Students = append(result.Students, student)
+	}
+	return result, rows.Err()
+}
+
+func (self *SqlDb) loadRoster(dbName string) ([]rosterEntry, error) {
+	rows, err := self.dbClient.Query(`SELECT student, name, grade, class, status FROM roster`)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer rows.Close()
+	entries := []rosterEntry{}
+	for rows.Next() {
+		e := rosterEntry{}
+		name, class := sql.NullString{}, sql.NullString{}
+		if err = rows.Scan(&e.Student, &name, &e.Grade, &class, &e.Status); err != nil {
+			return nil, err
+		}
+		e.Name, e.Class = name.String, class.String
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+const rosterMerge = `MERGE roster WITH (HOLDLOCK) AS t
+USING (SELECT @p1 AS student) AS s ON t.student = s.student
+WHEN MATCHED THEN UPDATE SET name = @p2, grade = @p3, class = @p4, status = @p5
+WHEN NOT MATCHED THEN INSERT (student, name, grade, class, status)
+VALUES (@p1, @p2, @p3, @p4, @p5);`
+
+//整个导入在一个事务中，部分失败时名册保持不变
+func (self *SqlDb) saveRoster(dbName string, entries []rosterEntry) error {
+	tx, err := self.dbClient.Begin()
+	if err != nil {
+		return err
+	}
+	for i := 0; err == nil && i < len(entries); i++ {
+		v := entries[i]
+		_, err = tx.Exec(rosterMerge, v.Student, v.Name, v.Grade, v.Class, v.Status)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//抽签结果整体以json保存，便于按种子复核
+func (self *SqlDb) saveLotteryDraw(dbName string, draw *lotteryDraw) error {
+	b, err := json.Marshal(draw)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.dbClient.Exec(`INSERT INTO lottery VALUES (@p1, @p2, @p3, @p4)`,
+		draw.Category, draw.Seed, draw.TimeStamp, string(b))
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+//与抽签结果相同，志愿分配的统计和每个学生分到的志愿整体以json保存
+func (self *SqlDb) saveAllocationReport(dbName string, report *allocationReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.dbClient.Exec(`INSERT INTO allocation VALUES (@p1, @p2, @p3, @p4)`,
+		report.Category, report.Seed, report.TimeStamp, string(b))
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (self *SqlDb) appendAudits(dbName string, entries []auditEntry,
+	retry bool) (int, error) {
+
+	rows := make([][]interface{}, len(entries))
+	for i, e := range entries {
+		rows[i] = []interface{}{e.Seq, e.TimeStamp, e.Action, e.Actor, e.Student,
+			e.Course, e.Result, e.Detail, e.IP, e.PrevHash, e.Hash}
+	}
+	if retry {
+		n, err := self.insertRowsOnce("audit_log", strings.Split(auditColumns, ", "),
+			[]int{0}, rows)
+		if err != nil {
+			log.Println(err)
+		}
+		return n, err
+	}
+	err := self.insertRows("audit_log", rows)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+const auditColumns = `seq, timestamp, action, actor, student, course, result, detail, ip, prev_hash, hash`
+
+func scanAudit(rows *sql.Rows) (auditEntry, error) {
+	e := auditEntry{}
+	err := rows.Scan(&e.Seq, &e.TimeStamp, &e.Action, &e.Actor, &e.Student,
+		&e.Course, &e.Result, &e.Detail, &e.IP, &e.PrevHash, &e.Hash)
+	return e, err
+}
+
+func (self *SqlDb) lastAuditEntry(dbName string) (auditEntry, error) {
+	rows, err := self.dbClient.Query(`SELECT TOP 1 ` + auditColumns + ` FROM audit_log ORDER BY seq DESC`)
+	if err != nil {
+		log.Println(err)
+		return auditEntry{}, err
+	}
+
+	defer rows.Close()
+	if !rows.Next() {
+		return auditEntry{}, errNotFound
+	}
+	return scanAudit(rows)
+}
+
+func (self *SqlDb) queryAudit(dbName, student string, from, to, since int64,
+	limit int) ([]auditEntry, error) {
+	sqlString := `SELECT TOP (@p1) ` + auditColumns + ` FROM audit_log WHERE seq>@p2`
+	args := []interface{}{limit, since}
+	if student != "" {
+		args = append(args, student)
+		sqlString += fmt.Sprintf(" AND student=@p%d", len(args))
+	}
+	if from > 0 {
+		args = append(args, from)
+		sqlString += fmt.Sprintf(" AND timestamp>=@p%d", len(args))
+	}
+	if to > 0 {
+		args = append(args, to)
+		sqlString += fmt.Sprintf(" AND timestamp<=@p%d", len(args))
+	}
+
+	rows, err := self.dbClient.Query(sqlString+" ORDER BY seq", args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	defer rows.Close()
+	entries := []auditEntry{}
+	for rows.Next() {
+		e, err := scanAudit(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//年级和班级的已报人数保存在seat_count表中，按课程表、课程和范围（grade:年级、
+//class:年级-班级）计数。max小于0表示不限，为0表示没有名额
+const seatCountMerge = `MERGE seat_count WITH (HOLDLOCK) AS t
+USING (SELECT @p1 AS course_table, @p2 AS course, @p3 AS scope) AS s
+ON t.course_table = s.course_table AND t.course = s.course AND t.scope = s.scope
+WHEN MATCHED AND (@p4 < 0 OR t.number < @p4) THEN UPDATE SET number = t.number + 1
+WHEN NOT MATCHED AND @p4 <> 0 THEN INSERT (course_table, course, scope, number)
+VALUES (s.course_table, s.course, s.scope, 1);`
+
+func affected(result sql.Result) bool {
+	n, err := result.RowsAffected()
+	return err == nil && n > 0
 }
 
+func seatScopes(c course, info studentInfo, force bool) ([]string, []int) {
+	scopes := []string{fmt.Sprintf("grade:%d", info.Grade)}
+	limits := []int{-1}
+	if max, ok := c.gradeQuota(info.Grade); ok && !force {
+		limits[0] = max
+	}
+	if info.Class != "" {
+		scopes = append(scopes, "class:"+info.classKey())
+		limits = append(limits, -1)
+		if c.ClassQuota > 0 && !force {
+			limits[1] = c.ClassQuota
+		}
+	}
+	return scopes, limits
+}
+
+//在一个事务中锁住学生在seat_holder中的记录，按这些记录检查重复报名和选课规则，
+//再用条件更新检查并增加总人数、年级和班级人数，任何一项已满时回滚并返回原因。
+//seat_holder的主键为(course_table, student, course)，同一学生不会重复占用名额
+func (self *SqlDb) reserveSeat(dbName, table string, c course, student string,
+	info studentInfo, force bool, check func([]string) string) (string, error) {
+
+	tx, err := self.dbClient.Begin()
+	if err != nil {
+		return "", err
+	}
+	rows, err := tx.Query(`SELECT course FROM seat_holder WITH (UPDLOCK, HOLDLOCK) WHERE course_table = @p1 AND student = @p2`,
+		table, student)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	held := []string{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		held = append(held, name)
+	}
+	rows.Close()
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if msg := check(held); msg != "" {
+		tx.Rollback()
+		return msg, nil
+	}
+	_, err = tx.Exec(`INSERT INTO seat_holder (course_table, student, course) VALUES (@p1, @p2, @p3)`,
+		table, student, c.Name)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	sqlString := "UPDATE " + table + " SET number = number + 1 WHERE name = @p1"
+	if !force {
+		sqlString += " AND number < total"
+	}
+	result, err := tx.Exec(sqlString, c.Name)
+	msg := ""
+	if err == nil && !affected(result) {
+		msg = "已报满"
+	}
+	scopes, limits := seatScopes(c, info, force)
+	for i := 0; err == nil && msg == "" && i < len(scopes); i++ {
+		result, err = tx.Exec(seatCountMerge, table, c.Name, scopes[i], limits[i])
+		if err == nil && !affected(result) {
+			msg = seatScopeFull[i]
+		}
+	}
+	if err != nil || msg != "" {
+		tx.Rollback()
+		return msg, err
+	}
+	return "", tx.Commit()
+}
+
+//与seatScopes返回的范围对应
+var seatScopeFull = []string{"本年级名额已满", "本班名额已满"}
+
+func (self *SqlDb) releaseSeat(dbName, table string, c course, student string,
+	info studentInfo) error {
+
+	tx, err := self.dbClient.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM seat_holder WHERE course_table = @p1 AND student = @p2 AND course = @p3`,
+		table, student, c.Name)
+	if err == nil {
+		_, err = tx.Exec("UPDATE "+table+" SET number = number - 1 WHERE name = @p1 AND number > 0",
+			c.Name)
+	}
+	scopes, _ := seatScopes(c, info, true)
+	for i := 0; err == nil && i < len(scopes); i++ {
+		_, err = tx.Exec(`UPDATE seat_count SET number = number - 1 WHERE course_table = @p1 AND course = @p2 AND scope = @p3 AND number > 0`,
+			table, c.Name, scopes[i])
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (self *SqlDb) loadSeats(dbName, table string) (map[string]seatCount, error) {
+	rows, err := self.dbClient.Query("SELECT name, number FROM " + table)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]seatCount{}
+	for rows.Next() {
+		var name string
+		n := newSeatCount()
+		if err = rows.Scan(&name, &n.Number); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts[name] = n
+	}
+	rows.Close()
+
+	rows, err = self.dbClient.Query(`SELECT course, scope, number FROM seat_count WHERE course_table = @p1`,
+		table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, scope string
+		var number int
+		if err = rows.Scan(&name, &scope, &number); err != nil {
+			return nil, err
+		}
+		n, ok := counts[name]
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(scope, "grade:") {
+			if grade, err := strconv.Atoi(scope[len("grade:"):]); err == nil {
+				n.Grades[grade] = number
+			}
+		} else if strings.HasPrefix(scope, "class:") {
+			n.Classes[scope[len("class:"):]] = number
+		}
+	}
+	return counts, rows.Err()
+}
+
+var dbClient = _dbs["mongo"]
+
 var _dbs = map[string]database{
 	"mongo": &MongoDb{},
 	"sql":   &SqlDb{},
 }
 
-var dbClient = _dbs["mongo"]
-
 func initDb(ds string) (err error) {
-	return dbClient.init(ds)
+	err = dbClient.init(ds)
+	//loadgen创建的测试学校不读写数据库
+	dbClient = syntheticDb{dbClient}
+	return err
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+type DbWriterConfig struct {
+	Writers       int `yaml:"writers"`        //写入协程数，默认4
+	BatchSize     int `yaml:"batch_size"`     //每批最多合并的条数，默认200
+	FlushInterval int `yaml:"flush_interval"` //凑批等待的最长时间（毫秒），默认20
+}
+
+type chanHandler interface {
+	handle() error
+	key() string        //key相同的数据由同一个写入协程按进入的顺序处理
+	letter() deadLetter //写入失败时转入死信队列的内容
+	queue(seq int64)
+	sequence() int64
+}
+
+//进入写入队列的序号，死信队列按序号重放，同一个key的数据保持进入队列的顺序
+type queued struct {
+	seq int64
+}
+
+func (self *queued) queue(seq int64) {
+	self.seq = seq
+}
+
+func (self *queued) sequence() int64 {
+	return self.seq
+}
+
+//可以与相邻的同类数据合并写入
+type batchHandler interface {
+	chanHandler
+	batch() string //batch相同的连续数据可以合并
+	//返回从头开始已经写入的条数，retry为true时按唯一键写入，已经写入的不会重复
+	handleBatch(handlers []chanHandler, retry bool) (int, error)
+}
+
+//每个写入协程一个channel，channel 的缓冲大小直接影响响应性能，可以根据情况调节缓冲大小
+var dbChannels []chan chanHandler
+
+//每个channel已进入和已处理（写入或转入死信队列）的条数，
+//channel已满直接转入死信队列的数据要等之前进入channel的数据处理完才能重放
+var dbSent []int64
+var dbDone []int64
+
+//从启动时间开始编号，重启后的序号大于之前留在死信队列中的数据
+var dbSeq = time.Now().UnixNano()
+
+//已进入dbChannels但还没有处理完的条数，以及已处理的条数，用于退出时等待写入完成
+var dbPending int64
+var dbHandled int64
+
+//退出时等待超时后不再写入数据库，还在队列中和之后进入的数据都转入死信队列
+var dbParking int32
+
+var errShuttingDown = errors.New("shutting down")
+var errQueueFull = errors.New("db write queue full")
+
+func (self DbWriterConfig) withDefaults() DbWriterConfig {
+	if self.Writers <= 0 {
+		self.Writers = 4
+	}
+	if self.BatchSize <= 0 {
+		self.BatchSize = 200
+	}
+	if self.FlushInterval <= 0 {
+		self.FlushInterval = 20
+	}
+	return self
+}
+
+func startDbWriters(cfg DbWriterConfig) {
+	cfg = cfg.withDefaults()
+	dbChannels = make([]chan chanHandler, cfg.Writers)
+	dbSent, dbDone = make([]int64, cfg.Writers), make([]int64, cfg.Writers)
+	for i := range dbChannels {
+		dbChannels[i] = make(chan chanHandler, 20000)
+		go dbRoutine(i, cfg)
+	}
+	go deadLetterRoutine()
+}
+
+func dbQueue(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(dbChannels)))
+}
+
+//按key把数据分配给写入协程，同一个学生的报名和取消总是按顺序写入。
+//调用者可能持有学校和课程的锁，channel已满时不等待，直接转入死信队列
+func dbWrite(handler chanHandler) {
+	handler.queue(atomic.AddInt64(&dbSeq, 1))
+	if atomic.LoadInt32(&dbParking) != 0 {
+		toDeadLetters([]chanHandler{handler}, errShuttingDown)
+		return
+	}
+
+	//先计数再进入channel，channel中的每条数据都已经计入dbSent
+	i := dbQueue(handler.key())
+	atomic.AddInt64(&dbPending, 1)
+	atomic.AddInt64(&dbSent[i], 1)
+	select {
+	case dbChannels[i] <- handler:
+	default:
+		atomic.AddInt64(&dbPending, -1)
+		sent := atomic.AddInt64(&dbSent[i], -1)
+		deadLetters.overflow(handler.key(), i, sent)
+		toDeadLetters([]chanHandler{handler}, errQueueFull)
+	}
+}
+
+func dbRoutine(i int, cfg DbWriterConfig) {
+	ch := dbChannels[i]
+	interval := time.Duration(cfg.FlushInterval) * time.Millisecond
+	batch := make([]chanHandler, 0, cfg.BatchSize)
+	for {
+		batch = append(batch[:0], <-ch)
+		timer := time.NewTimer(interval)
+	collect:
+		for len(batch) < cfg.BatchSize {
+			select {
+			case handler := <-ch:
+				batch = append(batch, handler)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		flushBatch(batch)
+		atomic.AddInt64(&dbDone[i], int64(len(batch)))
+		atomic.AddInt64(&dbHandled, int64(len(batch)))
+		atomic.AddInt64(&dbPending, -int64(len(batch)))
+	}
+}
+
+//按顺序处理，只合并相邻的同类数据，例如报名、取消、报名会分三次写入，
+//保证取消时能找到之前写入的报名记录
+func flushBatch(batch []chanHandler) {
+	for i := 0; i < len(batch); {
+		if atomic.LoadInt32(&dbParking) != 0 {
+			toDeadLetters(batch[i:], errShuttingDown)
+			return
+		}
+		//同一个学生之前的数据在死信队列中时，之后的数据也排到死信队列中，重放时按顺序写入
+		if deadLetters.park(batch[i]) {
+			i++
+			continue
+		}
+		b, ok := batch[i].(batchHandler)
+		if !ok {
+			writeOrPark(batch[i:i+1], handleOne)
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(batch) {
+			next, ok := batch[j].(batchHandler)
+			if !ok || next.batch() != b.batch() || deadLetters.parked(next.key()) {
+				break
+			}
+			j++
+		}
+		writeOrPark(batch[i:j], b.handleBatch)
+		i = j
+	}
+}
+
+func handleOne(handlers []chanHandler, retry bool) (int, error) {
+	if err := handlers[0].handle(); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
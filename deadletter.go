@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RetryConfig struct {
+	MaxRetries     int    `yaml:"max_retries"`      //写入失败后自动重放死信队列的次数，默认5
+	Backoff        int    `yaml:"backoff"`          //第一次重放前等待的毫秒数，之后每次加倍，默认100
+	MaxBackoff     int    `yaml:"max_backoff"`      //最长等待的毫秒数，默认5000
+	DeadLetterPath string `yaml:"dead_letter_path"` //死信队列文件，默认为程序所在目录下的deadletter.jsonl
+}
+
+const (
+	letterRegister   = "register"
+	letterUnRegister = "unregister"
+	letterAudit      = "audit"
+)
+
+//写入失败的数据，以json行的形式追加到死信队列文件中，由后台协程或管理员重放
+type deadLetter struct {
+	Seq       int64         `json:"seq"` //进入写入队列的序号
+	Type      string        `json:"type"`
+	Db        string        `json:"db"`
+	Register  *registerData `json:"register,omitempty"`
+	Student   string        `json:"student,omitempty"`
+	Course    string        `json:"course,omitempty"`
+	Audit     *auditEntry   `json:"audit,omitempty"`
+	Error     string        `json:"error"`
+	TimeStamp int64         `json:"timestamp"`
+}
+
+func (self deadLetter) handler() chanHandler {
+	var h chanHandler
+	switch self.Type {
+	case letterRegister:
+		h = &chanRegister{db: self.Db, data: *self.Register}
+	case letterUnRegister:
+		h = &chanUnRegister{db: self.Db, student: self.Student, course: self.Course}
+	case letterAudit:
+		h = &chanAudit{db: self.Db, entry: *self.Audit}
+	default:
+		return nil
+	}
+	h.queue(self.Seq)
+	return h
+}
+
+var retryConfig = RetryConfig{}.withDefaults()
+
+var dbRetries int64 //自动重放死信队列的次数
+var dbFailed int64  //转入死信队列的条数
+
+func (self RetryConfig) withDefaults() RetryConfig {
+	if self.MaxRetries <= 0 {
+		self.MaxRetries = 5
+	}
+	if self.Backoff <= 0 {
+		self.Backoff = 100
+	}
+	if self.MaxBackoff <= 0 {
+		self.MaxBackoff = 5000
+	}
+	if self.DeadLetterPath == "" {
+		self.DeadLetterPath = "deadletter.jsonl"
+	}
+	return self
+}
+
+//写入handlers，write返回从头开始已经写入的条数，失败时把剩下的handlers转入死信队列，
+//由deadLetterRoutine在写入协程之外按指数退避重放，写入协程不等待
+func writeOrPark(handlers []chanHandler, write func([]chanHandler, bool) (int, error)) {
+	n, err := write(handlers, false)
+	handlers = handlers[n:]
+	if err == nil {
+		return
+	}
+	//只有取消报名会返回errNotFound，要删除的记录不存在，重试也不会找到
+	if err == errNotFound {
+		log.Printf("db write skipped, %s: %v", handlers[0].key(), err)
+		return
+	}
+
+	log.Printf("db write failed, %d dead letters: %v", len(handlers), err)
+	toDeadLetters(handlers, err)
+}
+
+//把handlers追加到死信队列，err为转入的原因
+func toDeadLetters(handlers []chanHandler, err error) {
+	letters := make([]deadLetter, len(handlers))
+	for i, v := range handlers {
+		letters[i] = v.letter()
+		letters[i].Seq = v.sequence()
+		letters[i].Error = err.Error()
+		letters[i].TimeStamp = time.Now().Unix()
+	}
+	if e := deadLetters.append(letters); e != nil {
+		log.Println("dead letter:", e)
+		ColorRed(fmt.Sprintf("\n%d条数据无法写入死信队列：%v", len(handlers), e))
+	}
+	atomic.AddInt64(&dbFailed, int64(len(handlers)))
+	wakeDeadLetters()
+}
+
+var deadLetterWake = make(chan struct{}, 1)
+
+func wakeDeadLetters() {
+	select {
+	case deadLetterWake <- struct{}{}:
+	default:
+	}
+}
+
+//有数据转入死信队列后按指数退避自动重放，重放MaxRetries次仍有失败时
+//等到下一次转入死信队列，或者由管理员手动重放
+func deadLetterRoutine() {
+	for range deadLetterWake {
+		cfg := retryConfig
+		backoff := time.Duration(cfg.Backoff) * time.Millisecond
+		failed := 0
+		for i := 0; i < cfg.MaxRetries && atomic.LoadInt32(&dbParking) == 0; i++ {
+			time.Sleep(backoff)
+			atomic.AddInt64(&dbRetries, 1)
+			var err error
+			if _, failed, err = deadLetters.replay(); err != nil {
+				log.Println("dead letter replay:", err)
+			} else if failed == 0 {
+				break
+			}
+			backoff *= 2
+			if max := time.Duration(cfg.MaxBackoff) * time.Millisecond; backoff > max {
+				backoff = max
+			}
+		}
+		if failed > 0 {
+			ColorRed(fmt.Sprintf("\n死信队列中%d条数据自动重放失败，请检查数据库后手动重放", failed))
+		}
+	}
+}
+
+type deadLetterQueue struct {
+	m         sync.Mutex
+	waiting   map[string]bool //在队列中有数据的key，nil表示还没有读取队列文件
+	overflows map[string]overflowMark
+	replaying sync.Mutex //同时只有一个重放，重放写入数据库时不持有m
+}
+
+//channel已满时转入死信队列的key，queue中前sent条数据处理完之前不能重放，
+//否则会先于同一个学生之前进入channel的数据写入
+type overflowMark struct {
+	queue int
+	sent  int64
+}
+
+var deadLetters = &deadLetterQueue{}
+
+func (self *deadLetterQueue) append(letters []deadLetter) error {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.write(letters)
+}
+
+func (self *deadLetterQueue) overflow(key string, queue int, sent int64) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	if self.overflows == nil {
+		self.overflows = map[string]overflowMark{}
+	}
+	self.overflows[key] = overflowMark{queue, sent}
+}
+
+//调用者需持有self.m
+func (self *deadLetterQueue) settled(key string) bool {
+	mark, ok := self.overflows[key]
+	if !ok {
+		return true
+	}
+	done := atomic.LoadInt64(&dbDone[mark.queue])
+	if done < mark.sent && done != atomic.LoadInt64(&dbSent[mark.queue]) {
+		return false
+	}
+	delete(self.overflows, key)
+	return true
+}
+
+//key已有数据在队列中时把h也追加到队列，保持同一个学生的写入顺序
+func (self *deadLetterQueue) park(h chanHandler) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+	if !self.keys()[h.key()] {
+		return false
+	}
+
+	letter := h.letter()
+	letter.Seq = h.sequence()
+	letter.Error = "waiting for earlier dead letters"
+	letter.TimeStamp = time.Now().Unix()
+	if err := self.write([]deadLetter{letter}); err != nil {
+		log.Println("dead letter:", err)
+		ColorRed(fmt.Sprintf("\n%s的数据无法写入死信队列：%v", h.key(), err))
+	}
+	atomic.AddInt64(&dbFailed, 1)
+	wakeDeadLetters()
+	return true
+}
+
+func (self *deadLetterQueue) parked(key string) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.keys()[key]
+}
+
+//调用者需持有self.m
+func (self *deadLetterQueue) keys() map[string]bool {
+	if self.waiting != nil {
+		return self.waiting
+	}
+	self.waiting = map[string]bool{}
+	letters, err := self.read()
+	if err != nil {
+		log.Println("dead letter:", err)
+	}
+	for _, v := range letters {
+		if h := v.handler(); h != nil {
+			self.waiting[h.key()] = true
+		}
+	}
+	return self.waiting
+}
+
+//调用者需持有self.m
+func (self *deadLetterQueue) write(letters []deadLetter) error {
+	keys := self.keys()
+	for _, v := range letters {
+		if h := v.handler(); h != nil {
+			keys[h.key()] = true
+		}
+	}
+
+	f, err := os.OpenFile(retryConfig.DeadLetterPath,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, v := range letters {
+		b, _ := json.Marshal(&v)
+		if _, err = f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+//调用者需持有self.m
+func (self *deadLetterQueue) read() ([]deadLetter, error) {
+	f, err := os.Open(retryConfig.DeadLetterPath)
+	if os.IsNotExist(err) {
+		return []deadLetter{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	letters := []deadLetter{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		v := deadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			return nil, err
+		}
+		letters = append(letters, v)
+	}
+	return letters, scanner.Err()
+}
+
+func (self *deadLetterQueue) list() ([]deadLetter, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return self.read()
+}
+
+//按进入写入队列的顺序重新写入，仍然失败的数据保留在队列中，返回成功和失败的条数。
+//写入数据库时不持有self.m，写入协程可以同时向队列追加数据
+func (self *deadLetterQueue) replay() (int, int, error) {
+	self.replaying.Lock()
+	defer self.replaying.Unlock()
+
+	self.m.Lock()
+	letters, err := self.read()
+	settled := map[string]bool{}
+	for _, v := range letters {
+		if h := v.handler(); h != nil {
+			settled[h.key()] = self.settled(h.key())
+		}
+	}
+	self.m.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	read := len(letters)
+	//channel已满时转入的数据可能排在同一个学生之前进入channel的数据前面
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Seq < letters[j].Seq
+	})
+
+	remaining := []deadLetter{}
+	for _, v := range letters {
+		h := v.handler()
+		if h == nil {
+			continue
+		}
+		//同一个学生的数据有一条失败后，之后的也不能先写入
+		if !settled[h.key()] || (len(remaining) > 0 && blocked(remaining, h)) {
+			remaining = append(remaining, v)
+			continue
+		}
+		//要删除的报名记录不存在时不必保留
+		if err := h.handle(); err != nil && err != errNotFound {
+			v.Error = err.Error()
+			remaining = append(remaining, v)
+		}
+	}
+	failed := len(remaining)
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	//重放期间追加的数据保留在剩下的数据之后
+	current, err := self.read()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(current) > read {
+		remaining = append(remaining, current[read:]...)
+	}
+
+	tmp := retryConfig.DeadLetterPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, 0, err
+	}
+	w := bufio.NewWriter(f)
+	for _, v := range remaining {
+		b, _ := json.Marshal(&v)
+		w.Write(append(b, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	err = os.Rename(tmp, retryConfig.DeadLetterPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	self.waiting = map[string]bool{}
+	for _, v := range remaining {
+		if h := v.handler(); h != nil {
+			self.waiting[h.key()] = true
+		}
+	}
+	return read - failed, failed, nil
+}
+
+func blocked(remaining []deadLetter, h chanHandler) bool {
+	for _, v := range remaining {
+		if r := v.handler(); r != nil && r.key() == h.key() {
+			return true
+		}
+	}
+	return false
+}
+
+func handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	letters, err := deadLetters.list()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	b, _ := json.Marshal(&struct {
+		Data []deadLetter `json:"data"`
+	}{letters})
+	w.Write(b)
+}
+
+func handleDeadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	replayed, failed, err := deadLetters.replay()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(fmt.Sprintf(`{"replayed":%d,"failed":%d}`, replayed, failed)))
+}
@@ -1,20 +1,142 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
 )
 
+type AvatarFilesConfig struct {
+	MaxAge int  `yaml:"max_age"` //头像的缓存秒数，默认7天
+	Signed bool `yaml:"signed"`  //只允许访问带签名的地址，避免按学号枚举头像
+	UrlTtl int  `yaml:"url_ttl"` //签名地址的有效小时数，默认24
+}
+
+func (self AvatarFilesConfig) withDefaults() AvatarFilesConfig {
+	if self.MaxAge <= 0 {
+		self.MaxAge = 7 * 24 * 3600
+	}
+	if self.UrlTtl <= 0 {
+		self.UrlTtl = 24
+	}
+	return self
+}
+
+func avatarSignature(name string, expires int64) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(fmt.Sprintf("avatar\n%s\n%d", name, expires)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+//返回客户端访问头像用的地址（/avatar/之后的部分），启用签名时附加过期时间和签名。
+//过期时间取整到小时，同一小时内签发的地址相同，浏览器缓存仍然有效
+func signAvatar(name string) string {
+	cfg := config.AvatarFiles.withDefaults()
+	if name == "" || !cfg.Signed {
+		return name
+	}
+	expires := time.Now().Add(time.Duration(cfg.UrlTtl) * time.Hour).Unix()
+	expires += 3600 - expires%3600
+	return fmt.Sprintf("%s?expires=%d&sig=%s", name, expires, avatarSignature(name, expires))
+}
+
+func verifyAvatar(name string, query url.Values) bool {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(query.Get("sig")), []byte(avatarSignature(name, expires)))
+}
+
 type fileHandler string
 
 func FileServer(dir string) http.Handler {
 	return fileHandler(dir)
 }
 
+//不列出目录内容，文件带ETag和长期缓存头，文件不存在时返回按文件名生成的默认头像
 func (self fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "" {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	cfg := config.AvatarFiles.withDefaults()
+	if cfg.Signed && !verifyAvatar(r.URL.Path, r.URL.Query()) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	f, err := http.Dir(self).Open(path.Clean("/" + r.URL.Path))
+	if os.IsNotExist(err) {
+		serveDefaultAvatar(w, r)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", cfg.MaxAge))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+//按文件名生成左右对称的5×5色块图案，同一学生的默认头像总是相同。
+//学生之后可能上传头像，默认头像只缓存较短的时间
+func serveDefaultAvatar(w http.ResponseWriter, r *http.Request) {
+	sum := sha256.Sum256([]byte(r.URL.Path))
+	etag := fmt.Sprintf(`"default-%x"`, sum[:8])
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	const cells, cell, margin = 5, 24, 20
+	size := cells*cell + margin*2
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	background := color.RGBA{240, 240, 240, 255}
+	foreground := color.RGBA{sum[0]/2 + 64, sum[1]/2 + 64, sum[2]/2 + 64, 255}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetRGBA(x, y, background)
+		}
+	}
+	for row := 0; row < cells; row++ {
+		for col := 0; col < (cells+1)/2; col++ {
+			if sum[3+row*3+col]&1 == 0 {
+				continue
+			}
+			for _, c := range []int{col, cells - 1 - col} {
+				for y := 0; y < cell; y++ {
+					for x := 0; x < cell; x++ {
+						img.SetRGBA(margin+c*cell+x, margin+row*cell+y, foreground)
+					}
+				}
+			}
+		}
+	}
 
-	http.FileServer(http.Dir(self)).ServeHTTP(w, r)
+	buf := bytes.Buffer{}
+	png.Encode(&buf, img)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
 }
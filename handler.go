@@ -5,21 +5,94 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"time"
 )
 
-func isMultiRegistered(s *school, student, course string) bool {
+func (s *school) findCourse(name string) *courseObj {
 	for _, v := range s.courses {
-		if course != v.c.Name {
-			_, ok := v.students[student]
-			if ok {
-				return true
-			}
+		if name == v.c.Name {
+			return v
 		}
 	}
+	return nil
+}
 
-	return false
+//报名，先到先得模式下调用者持有s.m读锁即可，抽签模式下需持有写锁。
+//先锁住学生所在分片检查选课规则，再锁住课程检查名额，
+//同一学生同时报多门课时不会都通过选课规则检查。
+//审计记录e在决定结果的锁内追加，链条顺序与名额的分配顺序一致
+func (s *school) register(student, course string, info studentInfo, e auditEntry) (int, string) {
+	result := func(code int, msg string) (int, string) {
+		e.Result = msg
+		s.audit(e)
+		return code, msg
+	}
+	if !s.started {
+		return result(1, "报名未开始")
+	}
+	if s.mode == modeLottery {
+		return result(s.apply(student, course, info))
+	}
+	if s.mode == modeRanked {
+		return result(1, "请填报志愿")
+	}
+	v := s.findCourse(course)
+	if v == nil {
+		return result(1, "报名失败")
+	}
+
+	shard := s.shard(student)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	if msg := s.checkSelection(shard.selected[student], v); msg != "" {
+		return result(1, msg)
+	}
+	e.Result = "报名成功"
+	c, msg := s.reserve(student, v, info, false, &e)
+	if msg != "" {
+		return 1, msg
+	}
+
+	shard.index(student, v)
+	//在分片锁内进入写入队列，同一学生的报名和取消按发生的顺序写入
+	s.registerDb(student, c)
+	s.notify(notifyRegistered, student, v)
+	return 0, e.Result
+}
+
+//取消报名，锁的要求和审计记录与register相同，撤回抽签申请时需持有s.m写锁
+func (s *school) cancel(student, course string, e auditEntry) (int, string) {
+	result := func(code int, msg string) (int, string) {
+		e.Result = msg
+		s.audit(e)
+		return code, msg
+	}
+	if s.mode == modeLottery && !s.closed {
+		if s.withdraw(student, course) {
+			return result(0, "已撤回抽签申请")
+		}
+		return result(1, "取消失败")
+	}
+
+	shard := s.shard(student)
+	shard.m.Lock()
+	defer shard.m.Unlock()
+	if code, msg := s.checkCancel(student); code != 0 {
+		return result(code, msg)
+	}
+	v := s.findCourse(course)
+	if v == nil {
+		return result(1, "取消失败")
+	}
+	e.Result = "取消成功"
+	if !s.release(student, v, &e) {
+		return 1, e.Result
+	}
+
+	shard.unindex(student, v)
+	shard.cancels[student] += 1
+	s.unRegisterDb(student, course)
+	s.notify(notifyCancelled, student, v)
+	return 0, e.Result
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -35,35 +108,37 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	actor, ok := school.actor(r, student)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !school.onRoster(student) {
+		school.auditRequest(r, auditRegister, actor, student, course, msgNotOnRoster)
+		w.Write([]byte(fmt.Sprintf(`{"errCode":1,"errMsg":"%s"}`, msgNotOnRoster)))
+		return
+	}
+	info, err := school.studentInfo(student)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	errCode := 1
-	errMsg := "报名失败"
-	school.m.Lock()
-	if !school.started {
-		errMsg = "报名未开始"
-	} else if isMultiRegistered(school, student, course) {
-		errMsg = "禁止报多门课"
-	} else {
-		for _, v := range school.courses {
-			if course == v.c.Name {
-				if v.c.Number < v.c.Total {
-					if _, ok := v.students[student]; ok {
-						errMsg = "重复报名"
-					} else {
-						v.c.Number += 1
-						v.students[student] = true
-						school.registerDb(student, v.c)
-						errCode = 0
-						errMsg = "报名成功"
-					}
-				} else {
-					errMsg = "已报满"
-				}
-				break
-			}
-		}
+	var errCode int
+	var errMsg string
+	e := requestAudit(r, auditRegister, actor, student, course)
+	school.m.RLock()
+	lottery := school.mode == modeLottery
+	if !lottery {
+		errCode, errMsg = school.register(student, course, info, e)
+	}
+	school.m.RUnlock()
+	//抽签申请会修改课程的申请名单，需要写锁
+	if lottery {
+		school.m.Lock()
+		errCode, errMsg = school.register(student, course, info, e)
+		school.m.Unlock()
 	}
-	school.m.Unlock()
 
 	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s"}`, errCode, errMsg)))
 }
@@ -81,23 +156,26 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	actor, ok := school.actor(r, student)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 
-	errCode := 1
-	errMsg := "取消失败"
-	school.m.Lock()
-	for _, v := range school.courses {
-		if course == v.c.Name {
-			if _, ok := v.students[student]; ok {
-				v.c.Number -= 1
-				delete(v.students, student)
-				errCode = 0
-				errMsg = "取消成功"
-				school.unRegisterDb(student, course)
-			}
-			break
-		}
+	var errCode int
+	var errMsg string
+	e := requestAudit(r, auditCancel, actor, student, course)
+	school.m.RLock()
+	withdraw := school.mode == modeLottery && !school.closed
+	if !withdraw {
+		errCode, errMsg = school.cancel(student, course, e)
+	}
+	school.m.RUnlock()
+	if withdraw {
+		school.m.Lock()
+		errCode, errMsg = school.cancel(student, course, e)
+		school.m.Unlock()
 	}
-	school.m.Unlock()
 
 	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s"}`, errCode, errMsg)))
 }
@@ -111,19 +189,6 @@ func gradeFilter(grades []int, grade int) bool {
 	return false
 }
 
-func getGrade(year int) int {
-	t := time.Now()
-	grade := t.Year() - 2000 - year
-	if grade >= 0 && grade <= 5 {
-		if t.Month() >= 9 {
-			grade++
-		}
-		return grade
-	}
-
-	return 0
-}
-
 func handleCourse(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil || len(r.Form) != 2 {
@@ -136,14 +201,25 @@ func handleCourse(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !school.onRoster(student) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 
-	year, _ := strconv.ParseInt(student[0:2], 10, 32)
-	grade := getGrade(int(year))
+	info, err := school.studentInfo(student)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	var cl = courseList{[]course{}}
 	school.m.RLock()
 	for _, v := range school.courses {
-		if gradeFilter(v.c.Grade, grade) {
-			cl.Data = append(cl.Data, v.c)
+		if gradeFilter(v.c.Grade, info.Grade) {
+			v.m.Lock()
+			c := v.c
+			c.Remaining = v.remaining(info)
+			v.m.Unlock()
+			cl.Data = append(cl.Data, c)
 		}
 	}
 	school.m.RUnlock()
@@ -162,10 +238,13 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	school := getSchool(r.FormValue("school"))
-	if school.started {
-		w.Write([]byte(fmt.Sprintf(`{"status":"started","courseTag":"%s"}`, school.courseTag)))
+	school.m.RLock()
+	started, courseTag := school.started, school.courseTag
+	school.m.RUnlock()
+	if started {
+		w.Write([]byte(fmt.Sprintf(`{"status":"started","courseTag":"%s"}`, courseTag)))
 	} else {
-		w.Write([]byte(fmt.Sprintf(`{"status":"notStarted","courseTag":"%s"}`, school.courseTag)))
+		w.Write([]byte(fmt.Sprintf(`{"status":"notStarted","courseTag":"%s"}`, courseTag)))
 	}
 }
 
@@ -181,18 +260,40 @@ func handleRegisterInfo(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	course := ""
+	info := struct {
+		Course       string   `json:"course"` //兼容只能报一门课时的客户端
+		Courses      []course `json:"courses"`
+		Applications []string `json:"applications"` //抽签模式下已提交申请的课程
+	}{Courses: []course{}, Applications: []string{}}
 	school.m.RLock()
-	for _, v := range school.courses {
-		_, ok := v.students[student]
-		if ok {
-			course = v.c.Name
-			break
-		}
+	shard := school.shard(student)
+	shard.m.Lock()
+	for _, v := range school.selections(student) {
+		v.m.Lock()
+		info.Courses = append(info.Courses, v.c)
+		v.m.Unlock()
 	}
+	shard.m.Unlock()
+	lottery := school.mode == modeLottery && !school.closed
 	school.m.RUnlock()
+	//抽签申请在持有写锁时修改，只在抽签进行中读取
+	if lottery {
+		school.m.Lock()
+		for _, v := range school.applications(student) {
+			info.Applications = append(info.Applications, v.c.Name)
+		}
+		school.m.Unlock()
+	}
+	if len(info.Courses) > 0 {
+		info.Course = info.Courses[0].Name
+	}
 
-	w.Write([]byte(fmt.Sprintf(`{"course":"%s"}`, course)))
+	b, err := json.Marshal(&info)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Write(b)
 }
 
 func handleRegisterHistory(w http.ResponseWriter, r *http.Request) {
@@ -253,36 +354,38 @@ func handleGetTimer(w http.ResponseWriter, r *http.Request) {
 
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
-	if err != nil || len(r.Form) != 2 {
+	if err != nil || len(r.Form) < 2 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	school := getSchool(r.FormValue("school"))
+	if id := r.FormValue("parent"); id != "" && school != nil {
+		school.handleParentLogin(w, r, id)
+		return
+	}
 	student := r.FormValue("student")
-	if student == "" {
+	if student == "" || len(r.Form) != 2 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	errCode := 0
-	name, avatar, err := school.getStudentProfile(student)
+	token := ""
+	p, err := school.getStudentProfile(student)
+	//启用名册时以名册为准，没有学生资料的学生也可以登录
+	if school.rosterEnabled() {
+		err = nil
+		if e, ok := school.lookupRoster(student); !ok || e.Status != rosterActive {
+			err = errNotFound
+		} else if p.Name == "" {
+			p.Name = e.Name
+		}
+	}
 	if err != nil {
 		errCode = 1
+	} else {
+		token = school.issueToken(student)
 	}
-	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"name":"%s","avatar":"%s"}`, errCode, name, avatar)))
-}
-
-func handleAuthorize(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
-	if err != nil || len(r.Form) != 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	code := r.FormValue("code")
-	if code == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	w.Write([]byte("Not implemented"))
+	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"name":"%s","avatar":"%s","token":"%s"}`,
+		errCode, p.Name, signAvatar(p.Avatar), token)))
 }
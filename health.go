@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+type ReadyConfig struct {
+	MaxBacklog int64 `yaml:"max_backlog"` //dbChannels中未写入的条数超过该值时不可用，默认10000
+}
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//进程存活即返回200
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+//readyz不需要验证，数据库的错误信息只写入日志
+func checkDatabase() healthCheck {
+	if err := dbClient.ping(); err != nil {
+		log.Println("readyz:", err)
+		return healthCheck{false, "database unreachable"}
+	}
+	return healthCheck{OK: true}
+}
+
+func checkBacklog(max int64) (healthCheck, int64) {
+	if max <= 0 {
+		max = 10000
+	}
+	pending := atomic.LoadInt64(&dbPending)
+	if pending > max {
+		return healthCheck{false, "db write backlog too large"}, pending
+	}
+	return healthCheck{OK: true}, pending
+}
+
+//已到加载时间的报名，课程必须已经加载
+func checkCourses() healthCheck {
+	type session struct {
+		s    *school
+		name string
+	}
+	due := []session{}
+	mutexTimers.Lock()
+	for k := range tHandlers {
+		if c, ok := k.(*CourseStartHandler); ok && c.seconds <= c.secondsToLoad {
+			due = append(due, session{c.s, c.name})
+		}
+	}
+	mutexTimers.Unlock()
+
+	for _, v := range due {
+		v.s.m.RLock()
+		loaded := v.s.courseTag == v.name && len(v.s.courses) > 0
+		v.s.m.RUnlock()
+		if !loaded {
+			return healthCheck{false, v.s.name + " " + v.name + " courses not loaded"}
+		}
+	}
+	return healthCheck{OK: true}
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	result := struct {
+		Status   string      `json:"status"`
+		Database healthCheck `json:"database"`
+		Backlog  healthCheck `json:"backlog"`
+		Pending  int64       `json:"pending"`
+		Courses  healthCheck `json:"courses"`
+	}{Status: "ok"}
+
+	result.Database = checkDatabase()
+	result.Backlog, result.Pending = checkBacklog(config.Ready.MaxBacklog)
+	result.Courses = checkCourses()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Database.OK || !result.Backlog.OK || !result.Courses.OK {
+		result.Status = "fail"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	b, _ := json.Marshal(&result)
+	w.Write(b)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ServerConfig struct {
+	Listen         string   `yaml:"listen"`          //监听地址，默认:443
+	TLS            *bool    `yaml:"tls"`             //是否使用https，默认true，在反向代理后面运行时可以关闭
+	RedirectListen string   `yaml:"redirect_listen"` //把http请求跳转到https的监听地址，例如:80，为空表示不启用
+	ReadTimeout    int      `yaml:"read_timeout"`    //秒，默认5
+	WriteTimeout   int      `yaml:"write_timeout"`   //秒，0表示不限
+	IdleTimeout    int      `yaml:"idle_timeout"`    //秒，0表示与ReadTimeout相同
+	TrustedProxies []string `yaml:"trusted_proxies"` //可信反向代理的IP或网段，只采用来自这些地址的X-Forwarded-For
+	CertReload     int      `yaml:"cert_reload"`     //检查证书文件是否更新的间隔秒数，默认10
+}
+
+func (self ServerConfig) listen() string {
+	if self.Listen == "" {
+		return ":443"
+	}
+	return self.Listen
+}
+
+func (self ServerConfig) tls() bool {
+	return self.TLS == nil || *self.TLS
+}
+
+//redirectServer在服务器开始监听后创建，与shutdown之间由mutexServers保护
+var redirectServer *http.Server
+var mutexServers sync.Mutex
+var serversClosed bool
+
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(proxies []string) error {
+	trustedProxies = nil
+	for _, v := range proxies {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, ipnet)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, v := range trustedProxies {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//请求来自可信反向代理时，从X-Forwarded-For中由右向左取第一个不可信的地址，
+//没有X-Forwarded-For时使用X-Real-IP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ips := strings.Split(forwarded, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+		return strings.TrimSpace(ips[0])
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	return host
+}
+
+//证书文件更新后自动重新加载，不需要重启服务，报名中的状态不受影响
+type certReloader struct {
+	m        sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	interval int64
+	seconds  int64
+}
+
+func newCertReloader(certPath, keyPath string, interval int) (*certReloader, error) {
+	if interval <= 0 {
+		interval = 10
+	}
+	self := &certReloader{certPath: certPath, keyPath: keyPath, interval: int64(interval)}
+	return self, self.load()
+}
+
+func (self *certReloader) lastModified() time.Time {
+	t := time.Time{}
+	for _, v := range []string{self.certPath, self.keyPath} {
+		if info, err := os.Stat(v); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+func (self *certReloader) load() error {
+	modTime := self.lastModified()
+	cert, err := tls.LoadX509KeyPair(self.certPath, self.keyPath)
+	if err != nil {
+		return err
+	}
+	self.m.Lock()
+	self.cert = &cert
+	self.modTime = modTime
+	self.m.Unlock()
+	return nil
+}
+
+func (self *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	self.m.RLock()
+	defer self.m.RUnlock()
+	return self.cert, nil
+}
+
+func (self *certReloader) handle() int {
+	self.seconds += 1
+	if self.seconds%self.interval != 0 {
+		return Continue()
+	}
+
+	self.m.RLock()
+	modTime := self.modTime
+	self.m.RUnlock()
+	if !self.lastModified().After(modTime) {
+		return Continue()
+	}
+
+	//证书和私钥可能没有同时更新完，加载失败时继续使用旧证书，下次再试
+	if err := self.load(); err != nil {
+		log.Println("reload certificate:", err)
+		return Continue()
+	}
+	ColorGreen("\n证书已重新加载")
+	return Continue()
+}
+
+func redirectHandler(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+//关闭跳转服务器，之后startServer不再启动跳转服务器
+func closeRedirectServer() {
+	mutexServers.Lock()
+	defer mutexServers.Unlock()
+	serversClosed = true
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
+}
+
+func timeout(n, defaultValue int) time.Duration {
+	if n <= 0 {
+		n = defaultValue
+	}
+	return time.Duration(n) * time.Second
+}
+
+//启动监听，ready在服务器对象创建之后、开始监听之前调用，
+//返回的错误不包括调用shutdown后的http.ErrServerClosed
+func startServer(cfg ServerConfig, ready func()) error {
+	err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	server = &http.Server{
+		Addr:         cfg.listen(),
+		ReadTimeout:  timeout(cfg.ReadTimeout, 5),
+		WriteTimeout: timeout(cfg.WriteTimeout, 0),
+		IdleTimeout:  timeout(cfg.IdleTimeout, 0),
+	}
+	if !cfg.tls() {
+		fmt.Printf("Starting server on %s (http) ...\n", cfg.listen())
+		ready()
+		err = server.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+
+	var reloader *certReloader
+	reloader, err = newCertReloader(config.Cert, config.Key, cfg.CertReload)
+	if err != nil {
+		return err
+	}
+	RegisterTHandler(reloader)
+	server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+
+	if cfg.RedirectListen != "" {
+		redirect := &http.Server{
+			Addr:         cfg.RedirectListen,
+			Handler:      redirectHandler(cfg.listen()),
+			ReadTimeout:  timeout(cfg.ReadTimeout, 5),
+			WriteTimeout: timeout(cfg.WriteTimeout, 0),
+		}
+		mutexServers.Lock()
+		if !serversClosed {
+			redirectServer = redirect
+			go func() {
+				err := redirect.ListenAndServe()
+				if err != http.ErrServerClosed {
+					log.Println(err)
+				}
+			}()
+		}
+		mutexServers.Unlock()
+	}
+
+	fmt.Printf("Starting server on %s ...\n", cfg.listen())
+	ready()
+	err = server.ListenAndServeTLS("", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
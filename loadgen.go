@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const syntheticPrefix = "loadgen-"
+
+//创建只在内存中的测试学校和课程，并在start秒后开始报名，学校名称必须以loadgen-开头，
+//测试学校的所有数据库操作由syntheticDb转给nullDb，不会读写正式的数据
+func handleSynthetic(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("school")
+	courses, err1 := strconv.Atoi(r.FormValue("courses"))
+	seats, err2 := strconv.Atoi(r.FormValue("seats"))
+	start, err3 := strconv.ParseInt(r.FormValue("start"), 10, 64)
+	if !strings.HasPrefix(name, syntheticPrefix) || err1 != nil || err2 != nil ||
+		err3 != nil || courses <= 0 || seats <= 0 || start <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	grades := []int{}
+	for i := 1; i <= 12; i++ {
+		grades = append(grades, i)
+	}
+	s := getSchool(name)
+	objs := make([]*courseObj, courses)
+	for i := range objs {
+		objs[i] = NewCourseObj(course{Name: fmt.Sprintf("课程%03d", i+1),
+			Teacher: "loadgen", Total: seats, Grade: grades})
+	}
+	s.m.Lock()
+	s.courses = objs
+	s.started = false
+	s.courseTag = "loadgen"
+	s.mode = modeFcfs
+	s.closed = false
+	s.resetShards()
+	s.m.Unlock()
+
+	//secondsToLoad为-1，到时间后直接开始，不从数据库加载课程
+	RegisterTHandler(&CourseStartHandler{s, "loadgen", "", start, -1})
+	w.Write([]byte(`{"errCode":0}`))
+}
+
+type loadResult struct {
+	endpoint string
+	latency  time.Duration
+	outcome  string //http状态码或errMsg
+}
+
+type loadStats struct {
+	m         sync.Mutex
+	results   []loadResult
+	succeeded map[string]int //每门课程报名成功的人数
+}
+
+func (self *loadStats) add(r loadResult) {
+	self.m.Lock()
+	self.results = append(self.results, r)
+	self.m.Unlock()
+}
+
+type loadClient struct {
+	client *http.Client
+	target string
+	token  string
+	school string
+	stats  *loadStats
+}
+
+//header为管理员或学生的令牌，查询等不需要确认身份的接口为nil
+func (self *loadClient) post(endpoint string, form url.Values, header http.Header) (map[string]interface{}, error) {
+	req, _ := http.NewRequest(http.MethodPost, self.target+endpoint,
+		strings.NewReader(form.Encode()))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	start := time.Now()
+	resp, err := self.client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		self.stats.add(loadResult{endpoint, latency, "error"})
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		self.stats.add(loadResult{endpoint, latency, strconv.Itoa(resp.StatusCode)})
+		return nil, fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+
+	result := map[string]interface{}{}
+	json.Unmarshal(b, &result)
+	outcome := "200"
+	if msg, ok := result["errMsg"].(string); ok {
+		outcome = msg
+	}
+	self.stats.add(loadResult{endpoint, latency, outcome})
+	return result, nil
+}
+
+//模拟一个学生：等待报名开始，查询课程，选一门还有名额的课程报名，报满时换一门
+func (self *loadClient) student(id string) {
+	form := url.Values{"school": {self.school}}
+	for {
+		result, err := self.post("/status", form, nil)
+		if err == nil && result["status"] == "started" {
+			break
+		}
+		time.Sleep(time.Duration(100+rand.Intn(200)) * time.Millisecond)
+	}
+
+	//报名需要学生本人的令牌
+	result, err := self.post("/login", url.Values{"school": {self.school}, "student": {id}}, nil)
+	token, _ := result["token"].(string)
+	if err != nil || token == "" {
+		return
+	}
+	auth := http.Header{"Authorization": {"Bearer " + token}}
+
+	for attempt := 0; attempt < 3; attempt++ {
+		result, err := self.post("/course",
+			url.Values{"school": {self.school}, "student": {id}}, nil)
+		if err != nil {
+			return
+		}
+		available := []string{}
+		data, _ := result["data"].([]interface{})
+		for _, v := range data {
+			c, _ := v.(map[string]interface{})
+			if remaining, _ := c["remaining"].(float64); remaining > 0 {
+				available = append(available, c["name"].(string))
+			}
+		}
+		if len(available) == 0 {
+			return
+		}
+
+		name := available[rand.Intn(len(available))]
+		result, err = self.post("/register",
+			url.Values{"school": {self.school}, "student": {id}, "course": {name}}, auth)
+		if err != nil {
+			return
+		}
+		if code, _ := result["errCode"].(float64); code == 0 {
+			self.stats.m.Lock()
+			self.stats.succeeded[name]++
+			self.stats.m.Unlock()
+			return
+		}
+	}
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies)-1) * p)
+	return latencies[i]
+}
+
+func (self *loadStats) report(elapsed time.Duration) {
+	byEndpoint := map[string][]time.Duration{}
+	outcomes := map[string]int{}
+	for _, v := range self.results {
+		byEndpoint[v.endpoint] = append(byEndpoint[v.endpoint], v.latency)
+		outcomes[v.endpoint+" "+v.outcome]++
+	}
+
+	fmt.Printf("\n共%d个请求，用时%v，%.1f请求/秒\n", len(self.results),
+		elapsed.Round(time.Millisecond), float64(len(self.results))/elapsed.Seconds())
+	endpoints := []string{}
+	for k := range byEndpoint {
+		endpoints = append(endpoints, k)
+	}
+	sort.Strings(endpoints)
+	for _, k := range endpoints {
+		v := byEndpoint[k]
+		sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+		fmt.Printf("%-10s n=%-7d p50=%-10v p90=%-10v p99=%-10v max=%v\n", k, len(v),
+			percentile(v, 0.5), percentile(v, 0.9), percentile(v, 0.99), v[len(v)-1])
+	}
+
+	fmt.Println("\n结果分布：")
+	keys := []string{}
+	for k := range outcomes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("  %-30s %d\n", k, outcomes[k])
+	}
+}
+
+//报名结束后检查服务器上每门课程的已报人数不超过总人数，并且与成功的报名数一致
+func (self *loadClient) verify(student string, seats int) bool {
+	result, err := self.post("/course",
+		url.Values{"school": {self.school}, "student": {student}}, nil)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	ok := true
+	data, _ := result["data"].([]interface{})
+	for _, v := range data {
+		c, _ := v.(map[string]interface{})
+		name, _ := c["name"].(string)
+		number, _ := c["number"].(float64)
+		total, _ := c["total"].(float64)
+		if int(number) > int(total) || int(total) != seats {
+			ColorRed(fmt.Sprintf("%s超报：%d/%d", name, int(number), int(total)))
+			ok = false
+		}
+		if int(number) != self.stats.succeeded[name] {
+			ColorRed(fmt.Sprintf("%s人数不一致：服务器%d，成功报名%d", name,
+				int(number), self.stats.succeeded[name]))
+			ok = false
+		}
+	}
+	return ok
+}
+
+//本地模式使用的数据库，丢弃所有写入，用于单独测量内存中报名处理的吞吐量
+type nullDb struct{}
+
+func (self nullDb) init(string) error { return nil }
+func (self nullDb) ping() error       { return nil }
+
+func (self nullDb) loadCourses(string, string) ([]*courseObj, error) {
+	return []*courseObj{}, nil
+}
+
+func (self nullDb) registerCourse(string, string, string, string, int64) error { return nil }
+func (self nullDb) registerCourses(_ string, data []registerData, _ bool) (int, error) {
+	return len(data), nil
+}
+func (self nullDb) unRegisterCourse(string, string, string) error { return nil }
+
+func (self nullDb) getRegisterHistory(string, string) ([]byte, error) {
+	return []byte(`{"data":[]}`), nil
+}
+
+//压测的学生都可以登录，年级和班级按学号推算
+func (self nullDb) getStudentProfile(string, string) (profile, error) {
+	return profile{}, nil
+}
+
+func (self nullDb) updateAvatar(string, string, string) error { return errNotFound }
+
+func (self nullDb) getParent(string, string, string) (parent, error) {
+	return parent{}, errNotFound
+}
+
+func (self nullDb) loadRoster(string) ([]rosterEntry, error) { return []rosterEntry{}, nil }
+func (self nullDb) saveRoster(string, []rosterEntry) error   { return nil }
+
+func (self nullDb) saveLotteryDraw(string, *lotteryDraw) error           { return nil }
+func (self nullDb) saveAllocationReport(string, *allocationReport) error { return nil }
+
+func (self nullDb) appendAudits(_ string, entries []auditEntry, _ bool) (int, error) {
+	return len(entries), nil
+}
+
+func (self nullDb) lastAuditEntry(string) (auditEntry, error) {
+	return auditEntry{}, errNotFound
+}
+
+func (self nullDb) queryAudit(string, string, int64, int64, int64, int) ([]auditEntry, error) {
+	return []auditEntry{}, nil
+}
+
+func (self nullDb) reserveSeat(string, string, course, string, studentInfo, bool,
+	func([]string) string) (string, error) {
+	return "", nil
+}
+
+func (self nullDb) releaseSeat(string, string, course, string, studentInfo) error { return nil }
+
+func (self nullDb) loadSeats(string, string) (map[string]seatCount, error) {
+	return map[string]seatCount{}, nil
+}
+
+//SQL Server的表不按学校区分，测试学校如果使用正式的数据库会写入正式的报名表和审计表，
+//还会读到同学号学生的资料和家长，因此测试学校的数据库操作都转给nullDb
+type syntheticDb struct {
+	database
+}
+
+func (self syntheticDb) db(dbName string) database {
+	if strings.HasPrefix(dbName, syntheticPrefix) {
+		return nullDb{}
+	}
+	return self.database
+}
+
+func (self syntheticDb) loadCourses(dbName, table string) ([]*courseObj, error) {
+	return self.db(dbName).loadCourses(dbName, table)
+}
+
+func (self syntheticDb) registerCourse(dbName, student, course, teacher string, timestamp int64) error {
+	return self.db(dbName).registerCourse(dbName, student, course, teacher, timestamp)
+}
+
+func (self syntheticDb) registerCourses(dbName string, data []registerData, retry bool) (int, error) {
+	return self.db(dbName).registerCourses(dbName, data, retry)
+}
+
+func (self syntheticDb) unRegisterCourse(dbName, student, course string) error {
+	return self.db(dbName).unRegisterCourse(dbName, student, course)
+}
+
+func (self syntheticDb) getRegisterHistory(dbName, student string) ([]byte, error) {
+	return self.db(dbName).getRegisterHistory(dbName, student)
+}
+
+func (self syntheticDb) getStudentProfile(dbName, student string) (profile, error) {
+	return self.db(dbName).getStudentProfile(dbName, student)
+}
+
+func (self syntheticDb) updateAvatar(dbName, student, avatar string) error {
+	return self.db(dbName).updateAvatar(dbName, student, avatar)
+}
+
+func (self syntheticDb) getParent(dbName, field, value string) (parent, error) {
+	return self.db(dbName).getParent(dbName, field, value)
+}
+
+func (self syntheticDb) loadRoster(dbName string) ([]rosterEntry, error) {
+	return self.db(dbName).loadRoster(dbName)
+}
+
+func (self syntheticDb) saveRoster(dbName string, entries []rosterEntry) error {
+	return self.db(dbName).saveRoster(dbName, entries)
+}
+
+func (self syntheticDb) saveLotteryDraw(dbName string, draw *lotteryDraw) error {
+	return self.db(dbName).saveLotteryDraw(dbName, draw)
+}
+
+func (self syntheticDb) saveAllocationReport(dbName string, report *allocationReport) error {
+	return self.db(dbName).saveAllocationReport(dbName, report)
+}
+
+func (self syntheticDb) appendAudits(dbName string, entries []auditEntry, retry bool) (int, error) {
+	return self.db(dbName).appendAudits(dbName, entries, retry)
+}
+
+func (self syntheticDb) lastAuditEntry(dbName string) (auditEntry, error) {
+	return self.db(dbName).lastAuditEntry(dbName)
+}
+
+func (self syntheticDb) queryAudit(dbName, student string, from, to, since int64,
+	limit int) ([]auditEntry, error) {
+
+	return self.db(dbName).queryAudit(dbName, student, from, to, since, limit)
+}
+
+func (self syntheticDb) reserveSeat(dbName, table string, c course, student string,
+	info studentInfo, force bool, check func([]string) string) (string, error) {
+
+	return self.db(dbName).reserveSeat(dbName, table, c, student, info, force, check)
+}
+
+func (self syntheticDb) releaseSeat(dbName, table string, c course, student string,
+	info studentInfo) error {
+
+	return self.db(dbName).releaseSeat(dbName, table, c, student, info)
+}
+
+func (self syntheticDb) loadSeats(dbName, table string) (map[string]seatCount, error) {
+	return self.db(dbName).loadSeats(dbName, table)
+}
+
+//在本进程中启动http服务器，用go build -race编译后运行可以检查报名处理中的数据竞争
+func startLocal() (string, string) {
+	dbClient = nullDb{}
+	config.AdminToken = strconv.FormatInt(time.Now().UnixNano(), 36)
+	startDbWriters(config.DbWriter)
+	time.AfterFunc(time.Second, IntervalHandler)
+	routes()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	go http.Serve(listener, nil)
+	return "http://" + listener.Addr().String(), config.AdminToken
+}
+
+func runLoadgen(args []string) {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := flags.String("target", "https://localhost", "address of the xsj server")
+	token := flags.String("token", "", "admin token of the xsj server")
+	students := flags.Int("students", 1000, "number of students")
+	courses := flags.Int("courses", 20, "number of courses")
+	seats := flags.Int("seats", 30, "seats per course")
+	delay := flags.Int64("delay", 10, "seconds until registration starts")
+	concurrency := flags.Int("concurrency", 200, "max concurrent students")
+	insecure := flags.Bool("insecure", false, "skip TLS certificate verification")
+	local := flags.Bool("local", false, "run the server in this process without a database")
+	flags.Parse(args)
+	if *local {
+		*target, *token = startLocal()
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: *concurrency,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: *insecure},
+	}
+	lc := &loadClient{
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		target: strings.TrimRight(*target, "/"),
+		token:  *token,
+		school: fmt.Sprintf("%s%d", syntheticPrefix, time.Now().Unix()),
+		stats:  &loadStats{succeeded: map[string]int{}},
+	}
+
+	_, err := lc.post("/admin/synthetic", url.Values{
+		"school":  {lc.school},
+		"courses": {strconv.Itoa(*courses)},
+		"seats":   {strconv.Itoa(*seats)},
+		"start":   {strconv.FormatInt(*delay, 10)},
+	}, http.Header{"X-Admin-Token": {lc.token}})
+	if err != nil {
+		fmt.Println("创建测试学校失败：", err)
+		os.Exit(1)
+	}
+	fmt.Printf("测试学校%s：%d名学生，%d门课程，每门%d人，%d秒后开始报名\n",
+		lc.school, *students, *courses, *seats, *delay)
+
+	//学号前两位为今年入学的年份，按默认学号格式都是一年级
+	year := time.Now().Year()
+	if time.Now().Month() < 9 {
+		year--
+	}
+	ids := make([]string, *students)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%02d%06d", year%100, i+1)
+	}
+
+	start := time.Now()
+	sem := make(chan struct{}, *concurrency)
+	wg := sync.WaitGroup{}
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			lc.student(id)
+			<-sem
+		}(id)
+	}
+	wg.Wait()
+
+	lc.stats.report(time.Since(start))
+	if len(ids) > 0 && lc.verify(ids[0], *seats) {
+		ColorGreen("\n校验通过：没有课程超报")
+	} else {
+		ColorRed("\n校验失败")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	modeFcfs    = "fcfs"    //先到先得
+	modeLottery = "lottery" //抽签
+)
+
+//每个报名类别的设置，按课程类别名称索引
+type SessionConfig struct {
+	Mode   string `yaml:"mode"`   //报名方式：fcfs、lottery或ranked，默认fcfs
+	Window int    `yaml:"window"` //抽签或填报志愿的时长（分钟），默认30
+	Seed   int64  `yaml:"seed"`   //随机种子，0表示使用当前时间
+
+	Algorithm string `yaml:"algorithm"` //志愿分配算法：rsd或da，默认rsd
+	Choices   int    `yaml:"choices"`   //最多填报的志愿数，默认5
+	Priority  string `yaml:"priority"`  //da算法中课程对学生的优先级，默认grade_desc
+
+	Cancel CancelPolicy `yaml:"cancel"` //取消报名的规则
+}
+
+type lotteryResult struct {
+	Course     string   `json:"course"`
+	Seed       int64    `json:"seed"`       //本课程使用的随机种子，由总种子和课程名称得出
+	Applicants []string `json:"applicants"` //按学号排序的申请名单
+	Winners    []string `json:"winners"`    //按抽中顺序排列
+}
+
+type lotteryDraw struct {
+	Category  string          `json:"category"`
+	Seed      int64           `json:"seed"`
+	TimeStamp int64           `json:"timestamp"`
+	Results   []lotteryResult `json:"results"`
+}
+
+func (s *school) sessionConfig() SessionConfig {
+	return s.config().Sessions[s.courseTag]
+}
+
+func (self SessionConfig) window() time.Duration {
+	if self.Window <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(self.Window) * time.Minute
+}
+
+func (self SessionConfig) validate() error {
+	switch self.Mode {
+	case "", modeFcfs, modeLottery, modeRanked:
+	default:
+		return fmt.Errorf("unknown mode %q", self.Mode)
+	}
+	switch self.Algorithm {
+	case "", algorithmRsd, algorithmDa:
+	default:
+		return fmt.Errorf("unknown algorithm %q", self.Algorithm)
+	}
+	switch self.Priority {
+	case "", priorityGradeDesc, priorityGradeAsc, priorityNone:
+	default:
+		return fmt.Errorf("unknown priority %q", self.Priority)
+	}
+	return self.Cancel.validate()
+}
+
+//启动时检查所有学校的报名设置，配置错误时拒绝启动
+func validateSessions(schools map[string]SchoolConfig) error {
+	for name, school := range schools {
+		for tag, session := range school.Sessions {
+			if err := session.validate(); err != nil {
+				return fmt.Errorf("schools.%s.sessions.%s: %v", name, tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+//返回学生已提交的抽签申请，调用者需持有s.m写锁
+func (s *school) applications(student string) []*courseObj {
+	applied := []*courseObj{}
+	for _, v := range s.courses {
+		if _, ok := v.applicants[student]; ok {
+			applied = append(applied, v)
+		}
+	}
+	return applied
+}
+
+//提交抽签申请，申请同样受选课规则和上课时间的限制，这样抽中的
+//课程不会互相冲突，调用者需持有s.m写锁
+func (s *school) apply(student, course string, info studentInfo) (int, string) {
+	if s.closed {
+		return 1, "抽签已截止"
+	}
+	v := s.findCourse(course)
+	if v == nil {
+		return 1, "报名失败"
+	}
+	if _, ok := v.applicants[student]; ok {
+		return 1, "重复报名"
+	}
+	if msg := s.checkSelection(s.applications(student), v); msg != "" {
+		return 1, msg
+	}
+	v.applicants[student] = info
+	return 0, "已提交抽签申请"
+}
+
+//撤回抽签申请，调用者需持有s.m写锁
+func (s *school) withdraw(student, course string) bool {
+	v := s.findCourse(course)
+	if v == nil {
+		return false
+	}
+	if _, ok := v.applicants[student]; !ok {
+		return false
+	}
+	delete(v.applicants, student)
+	return true
+}
+
+func courseSeed(seed int64, course string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(course))
+	return seed ^ int64(h.Sum64())
+}
+
+//对每门课程的申请名单按学号排序后用课程种子洗牌，依次录取直到
+//名额或年级、班级名额用完。相同的种子和申请名单总能得到相同的结果
+func drawCourse(v *courseObj, seed int64) lotteryResult {
+	result := lotteryResult{Course: v.c.Name, Seed: seed,
+		Applicants: make([]string, 0, len(v.applicants)), Winners: []string{}}
+	for k := range v.applicants {
+		result.Applicants = append(result.Applicants, k)
+	}
+	sort.Strings(result.Applicants)
+
+	order := make([]string, len(result.Applicants))
+	copy(order, result.Applicants)
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(order), func(i, j int) {
+		order[i], order[j] = order[j], order[i]
+	})
+
+	for _, student := range order {
+		info := v.applicants[student]
+		if _, ok := v.students[student]; ok || v.full(info) != "" {
+			continue
+		}
+		v.add(student, info)
+		result.Winners = append(result.Winners, student)
+	}
+	return result
+}
+
+func (s *school) drawLottery(seed int64) *lotteryDraw {
+	s.m.Lock()
+	draw := &lotteryDraw{Category: s.courseTag, Seed: seed,
+		TimeStamp: time.Now().Unix(), Results: []lotteryResult{}}
+	courses := make([]*courseObj, len(s.courses))
+	copy(courses, s.courses)
+	sort.Slice(courses, func(i, j int) bool {
+		return courses[i].c.Name < courses[j].c.Name
+	})
+	for _, v := range courses {
+		result := drawCourse(v, courseSeed(seed, v.c.Name))
+		for _, student := range result.Winners {
+			s.shard(student).index(student, v)
+			s.registerDb(student, v.c)
+			s.notify(notifyLotteryResult, student, v)
+		}
+		v.applicants = map[string]studentInfo{}
+		draw.Results = append(draw.Results, result)
+	}
+	s.closed = true
+	s.draw = draw
+	s.m.Unlock()
+	s.auditConsole(auditLottery, fmt.Sprintf("%s seed=%d", draw.Category, seed))
+
+	err := dbClient.saveLotteryDraw(s.name, draw)
+	if err != nil {
+		log.Println(err)
+	}
+	return draw
+}
+
+//抽签申请或志愿填报截止后进行分配
+type LotteryCloseHandler struct {
+	s       *school
+	name    string //课程类别名称
+	seconds int64  //离截止的时间
+}
+
+func (self *LotteryCloseHandler) handle() int {
+	self.seconds -= 1
+	if self.seconds > 0 {
+		return Continue()
+	}
+
+	//截止前重新加载了其它类别的课程，本次抽签作废
+	self.s.m.RLock()
+	valid := self.s.courseTag == self.name && !self.s.closed
+	mode := self.s.mode
+	self.s.m.RUnlock()
+	if !valid {
+		return Quit()
+	}
+
+	seed := self.s.sessionConfig().Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	//抽签在定时器协程中进行，避免阻塞其它定时器
+	timerTasks.Add(1)
+	go func() {
+		defer timerTasks.Done()
+		if mode == modeRanked {
+			report := self.s.allocate(seed)
+			ColorGreen(fmt.Sprintf("\n%s志愿分配已完成，随机种子：%d，%d人中%d人未分配",
+				self.name, report.Seed, report.Students, report.Unassigned))
+			return
+		}
+		draw := self.s.drawLottery(seed)
+		ColorGreen(fmt.Sprintf("\n%s抽签已完成，随机种子：%d", draw.Category, draw.Seed))
+	}()
+	return Quit()
+}
+
+//公布最近一次抽签的随机种子和各课程的申请、录取人数，完整名单保存在数据库中
+func handleLottery(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+
+	type courseSummary struct {
+		Course     string `json:"course"`
+		Seed       int64  `json:"seed"`
+		Applicants int    `json:"applicants"`
+		Winners    int    `json:"winners"`
+	}
+	summary := struct {
+		Category  string          `json:"category"`
+		Seed      int64           `json:"seed"`
+		TimeStamp int64           `json:"timestamp"`
+		Data      []courseSummary `json:"data"`
+	}{Data: []courseSummary{}}
+
+	school.m.RLock()
+	if draw := school.draw; draw != nil {
+		summary.Category = draw.Category
+		summary.Seed = draw.Seed
+		summary.TimeStamp = draw.TimeStamp
+		for _, v := range draw.Results {
+			summary.Data = append(summary.Data, courseSummary{v.Course, v.Seed,
+				len(v.Applicants), len(v.Winners)})
+		}
+	}
+	school.m.RUnlock()
+
+	b, _ := json.Marshal(&summary)
+	w.Write(b)
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,15 +17,27 @@ type course struct {
 	Total   int    `json:"total"`  //总人数
 	Number  int    `json:"number"` //已报人数
 	Grade   []int  `json:"grade"`  //适合年级
+	Group   string `json:"group"`  //课程分组，例如：艺术、体育
+
+	Schedule   []timeSlot `json:"schedule"`   //上课时间
+	GradeQuota []quota    `json:"gradeQuota"` //各年级名额上限
+	ClassQuota int        `json:"classQuota"` //每个班级名额上限，0表示不限
+	Remaining  int        `json:"remaining"`  //查询课程的学生所在年级、班级的剩余名额
 }
 
 type courseList struct {
 	Data []course `json:"data"`
 }
 
+//报名时先到先得模式下只持有school.m的读锁，课程的报名人数和名单由m保护，
+//持有school.m写锁时不需要再锁m
 type courseObj struct {
-	students map[string]bool //已报名的学生
-	c        course
+	m          sync.Mutex
+	students   map[string]studentInfo //已报名的学生
+	gradeCount map[int]int            //各年级已报人数
+	classCount map[string]int         //各班级已报人数
+	applicants map[string]studentInfo //抽签模式下提交申请的学生
+	c          course
 }
 
 type registerData struct {
@@ -34,19 +51,48 @@ type school struct {
 	m         sync.RWMutex
 	name      string
 	courses   []*courseObj
-	started   bool   //报名是否已经开始
+	started   bool //报名是否已经开始
+	startTime time.Time
 	courseTag string //正在报名的课程类别名称，例如：数学课
+	table     string //课程所在的数据表
+	mode      string //报名方式
+	closed    bool   //抽签模式下申请是否已截止
+	draw      *lotteryDraw
+	report    *allocationReport
+	//按志愿分配模式下学生提交的志愿
+	preferences map[string]*preference
+	shards      [studentShards]studentShard
+
+	auditChain auditChain
+	//每个课程表上一次加载的课程，再次加载时比较差异记入审计日志
+	snapshots map[string]map[string]course
+	roster    roster
+
+	mutexProfiles sync.Mutex
+	profiles      map[string]profileEntry //学生资料缓存
+	parents       map[string]parentEntry  //家长资料缓存
+	loginCodes    map[string]*loginCode   //发送给家长的登录验证码
 }
 
-var mutexSchool sync.RWMutex
-var schools = map[string]*school{}
+//学生选课索引的分片数
+const studentShards = 64
 
-func NewCourseObj(name, teacher string, total int, grade []int) *courseObj {
-	return &courseObj{students: map[string]bool{}, c: course{name, teacher, total, 0, grade}}
+//按学号分片的学生选课索引。锁的顺序为school.m、分片、课程，
+//同一学生的报名和取消在分片锁内串行，不同学生可以同时报名不同的课程
+type studentShard struct {
+	m        sync.Mutex
+	selected map[string][]*courseObj //学生已报名的课程，按报名顺序排列
+	cancels  map[string]int          //本次报名中学生取消的次数
 }
 
-func init() {
-	go dbRoutine()
+var mutexSchool sync.RWMutex
+var schools = map[string]*school{}
+
+func NewCourseObj(c course) *courseObj {
+	c.Number = 0
+	return &courseObj{students: map[string]studentInfo{},
+		gradeCount: map[int]int{}, classCount: map[string]int{},
+		applicants: map[string]studentInfo{}, c: c}
 }
 
 func getSchool(name string) *school {
@@ -69,11 +115,49 @@ func getSchool(name string) *school {
 	if s = schools[name]; s != nil {
 		return s
 	}
-	s = &school{name: name, courses: []*courseObj{}, started: false}
+	s = &school{name: name, courses: []*courseObj{}, started: false,
+		profiles: map[string]profileEntry{}, parents: map[string]parentEntry{},
+		loginCodes:  map[string]*loginCode{},
+		preferences: map[string]*preference{}}
+	s.resetShards()
 	schools[name] = s
 	return s
 }
 
+func (s *school) shard(student string) *studentShard {
+	h := fnv.New32a()
+	h.Write([]byte(student))
+	return &s.shards[h.Sum32()%studentShards]
+}
+
+//重新加载课程时清空索引，调用者需持有s.m写锁
+func (s *school) resetShards() {
+	for i := range s.shards {
+		s.shards[i].selected = map[string][]*courseObj{}
+		s.shards[i].cancels = map[string]int{}
+	}
+}
+
+//调用者需持有s.m写锁，或者持有s.m读锁和分片的锁
+func (self *studentShard) index(student string, v *courseObj) {
+	self.selected[student] = append(self.selected[student], v)
+}
+
+func (self *studentShard) unindex(student string, v *courseObj) {
+	selected := self.selected[student]
+	for i, c := range selected {
+		if c == v {
+			selected = append(selected[:i:i], selected[i+1:]...)
+			break
+		}
+	}
+	if len(selected) == 0 {
+		delete(self.selected, student)
+	} else {
+		self.selected[student] = selected
+	}
+}
+
 func (s *school) loadCourses(name, table string) error {
 	courses, err := dbClient.loadCourses(s.name, table)
 	if err != nil {
@@ -81,62 +165,187 @@ func (s *school) loadCourses(name, table string) error {
 		return err
 	}
 	s.m.Lock()
+	edits := s.courseEdits(table, courses)
 	s.courses = courses
 	s.started = false
 	s.courseTag = name
+	s.table = table
+	s.mode = s.sessionConfig().Mode
+	s.closed = false
+	s.preferences = map[string]*preference{}
+	s.draw, s.report = nil, nil //上一次报名的抽签和分配结果
+	s.resetShards()
+	shared := s.sharedSeats()
 	s.m.Unlock()
+	if shared {
+		s.syncSeats()
+	}
+	s.resetProfiles()
+	if s.rosterEnabled() {
+		s.reloadRoster()
+	}
+	s.auditConsole(auditCourseLoad, fmt.Sprintf("%s %s %d门课程", name, table, len(courses)))
+	for _, v := range edits {
+		s.audit(auditEntry{Action: auditCourseEdit, Actor: actorConsole, Course: v[0],
+			Detail: table + " " + v[1]})
+	}
 	return nil
 }
 
-func (s *school) getRegisterHistory(student string) ([]byte, error) {
-	return dbClient.getRegisterHistory(s.name, student)
+//课程在数据库中修改，重新加载时与同一课程表上一次加载的课程比较，
+//返回[课程名称, 变化]，调用者需持有s.m写锁
+func (s *school) courseEdits(table string, courses []*courseObj) [][2]string {
+	current := map[string]course{}
+	for _, v := range courses {
+		current[v.c.Name] = v.c
+	}
+	if s.snapshots == nil {
+		s.snapshots = map[string]map[string]course{}
+	}
+	previous, ok := s.snapshots[table]
+	s.snapshots[table] = current
+	if !ok {
+		return nil
+	}
+
+	names := []string{}
+	for k := range previous {
+		names = append(names, k)
+	}
+	for k := range current {
+		if _, ok := previous[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	edits := [][2]string{}
+	for _, name := range names {
+		old, hadOld := previous[name]
+		c, hasNew := current[name]
+		switch {
+		case !hadOld:
+			edits = append(edits, [2]string{name, "新增 " + courseFields(c)})
+		case !hasNew:
+			edits = append(edits, [2]string{name, "删除 " + courseFields(old)})
+		default:
+			if diff := courseDiff(old, c); diff != "" {
+				edits = append(edits, [2]string{name, diff})
+			}
+		}
+	}
+	return edits
 }
 
-func (s *school) getStudentProfile(student string) (string, string, error) {
-	return dbClient.getStudentProfile(s.name, student)
+//课程的设置，不包括已报人数
+func courseFields(c course) string {
+	c.Number, c.Remaining = 0, 0
+	b, _ := json.Marshal(&c)
+	return string(b)
 }
 
-type chanHandler interface {
-	handle()
+//按字段列出课程设置的变化，例如：total: 30→35
+func courseDiff(old, c course) string {
+	a, b := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	json.Unmarshal([]byte(courseFields(old)), &a)
+	json.Unmarshal([]byte(courseFields(c)), &b)
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	changes := []string{}
+	for _, k := range keys {
+		if string(a[k]) != string(b[k]) {
+			changes = append(changes, fmt.Sprintf("%s: %s→%s", k, a[k], b[k]))
+		}
+	}
+	return strings.Join(changes, "; ")
+}
+
+//报名开始，抽签和按志愿分配模式下同时开始截止倒计时
+func (s *school) start() {
+	s.m.Lock()
+	s.started = true
+	s.startTime = time.Now()
+	mode, tag := s.mode, s.courseTag
+	shared := s.sharedSeats()
+	s.m.Unlock()
+
+	//在定时器中调用，不能同步注册新的定时器
+	if shared {
+		go RegisterTHandler(&SeatSyncHandler{s: s, name: tag})
+	}
+	if mode == modeLottery || mode == modeRanked {
+		window := int64(s.sessionConfig().window() / time.Second)
+		go RegisterTHandler(&LotteryCloseHandler{s, tag, window})
+	}
+}
+
+func (s *school) getRegisterHistory(student string) ([]byte, error) {
+	return dbClient.getRegisterHistory(s.name, student)
 }
 
 type chanRegister struct {
+	queued
 	db   string
 	data registerData
 }
 
-func (self *chanRegister) handle() {
-	dbClient.registerCourse(self.db, self.data.Student,
-		self.data.Course, self.data.Teacher, self.data.TimeStamp)
+//重放死信时使用，可能已经写入过，按唯一键写入
+func (self *chanRegister) handle() error {
+	_, err := dbClient.registerCourses(self.db, []registerData{self.data}, true)
+	return err
+}
+
+func (self *chanRegister) key() string {
+	return self.db + "/" + self.data.Student
+}
+
+func (self *chanRegister) batch() string {
+	return "register/" + self.db
+}
+
+func (self *chanRegister) handleBatch(handlers []chanHandler, retry bool) (int, error) {
+	data := make([]registerData, len(handlers))
+	for i, v := range handlers {
+		data[i] = v.(*chanRegister).data
+	}
+	return dbClient.registerCourses(self.db, data, retry)
+}
+
+func (self *chanRegister) letter() deadLetter {
+	data := self.data
+	return deadLetter{Type: letterRegister, Db: self.db, Register: &data}
 }
 
 type chanUnRegister struct {
+	queued
 	db      string
 	student string
 	course  string
 }
 
-func (self *chanUnRegister) handle() {
-	dbClient.unRegisterCourse(self.db, self.student, self.course)
+func (self *chanUnRegister) handle() error {
+	return dbClient.unRegisterCourse(self.db, self.student, self.course)
 }
 
-//channel 的缓冲大小直接影响响应性能，可以根据情况调节缓冲大小
-var dbChannel = make(chan chanHandler, 20000)
+func (self *chanUnRegister) key() string {
+	return self.db + "/" + self.student
+}
 
-func dbRoutine() {
-	for {
-		handler := <-dbChannel
-		handler.handle()
-	}
+func (self *chanUnRegister) letter() deadLetter {
+	return deadLetter{Type: letterUnRegister, Db: self.db,
+		Student: self.student, Course: self.course}
 }
 
 func (s *school) registerDb(student string, c course) {
-	dbChannel <- &chanRegister{
+	dbWrite(&chanRegister{
 		db:   s.name,
 		data: registerData{student, c.Name, c.Teacher, time.Now().Unix()},
-	}
+	})
 }
 
 func (s *school) unRegisterDb(student, course string) {
-	dbChannel <- &chanUnRegister{s.name, student, course}
+	dbWrite(&chanUnRegister{db: s.name, student: student, course: course})
 }
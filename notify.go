@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+type NotifyConfig struct {
+	Smtp       SmtpConfig                `yaml:"smtp"`
+	Sms        SmsConfig                 `yaml:"sms"`
+	Wechat     WechatConfig              `yaml:"wechat"`
+	Templates  map[string]NotifyTemplate `yaml:"templates"`   //按事件覆盖默认的通知内容
+	Queue      int                       `yaml:"queue"`       //等待发送的通知条数上限，超过时丢弃新的通知，默认10000
+	Workers    int                       `yaml:"workers"`     //发送通知的协程数，默认4
+	MaxRetries int                       `yaml:"max_retries"` //发送失败后的重试次数，默认5
+	Backoff    int                       `yaml:"backoff"`     //第一次重试前等待的秒数，之后每次加倍，默认5
+	MaxBackoff int                       `yaml:"max_backoff"` //最长等待的秒数，默认600
+	FailedPath string                    `yaml:"failed_path"` //重试后仍然失败的通知，默认为程序所在目录下的notify-failed.jsonl
+	OutboxPath string                    `yaml:"outbox_path"` //停止服务时还没有发送的通知，下次启动时继续发送，默认为程序所在目录下的notify-outbox.jsonl
+}
+
+//模板使用text/template语法，可以使用的字段见notifyData
+type NotifyTemplate struct {
+	Subject string            `yaml:"subject"` //邮件标题
+	Body    string            `yaml:"body"`    //邮件和短信正文
+	Wechat  string            `yaml:"wechat"`  //微信订阅消息模板ID，为空时不发送微信消息
+	Fields  map[string]string `yaml:"fields"`  //微信订阅消息的字段，例如thing1: "{{.Course}}"
+}
+
+type SmtpConfig struct {
+	Host     string `yaml:"host"` //为空时不发送邮件
+	Port     int    `yaml:"port"` //默认25
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+//短信网关接收POST的json：{"phone": "手机号", "text": "短信内容"}，返回2xx表示发送成功
+type SmsConfig struct {
+	Url  string `yaml:"url"`  //为空时不发送短信
+	Key  string `yaml:"key"`  //通过请求头Authorization: Bearer <key>发送给网关
+	Sign string `yaml:"sign"` //短信签名，加在正文前面，例如【某某学校】
+}
+
+type WechatConfig struct {
+	AppId  string `yaml:"app_id"` //为空时不发送微信消息
+	Secret string `yaml:"secret"`
+	ApiUrl string `yaml:"api_url"` //默认https://api.weixin.qq.com
+	Page   string `yaml:"page"`    //点击消息后打开的小程序页面
+}
+
+const (
+	notifyRegistered    = "registered"     //报名成功，包括管理员代报名
+	notifyCancelled     = "cancelled"      //取消报名，包括管理员退课
+	notifyLotteryResult = "lottery-result" //抽签或按志愿分配后公布的录取结果，只发给录取的学生
+
+	channelEmail  = "email"
+	channelSms    = "sms"
+	channelWechat = "wechat"
+)
+
+var defaultTemplates = map[string]NotifyTemplate{
+	notifyRegistered: {
+		Subject: "报名成功：{{.Course}}",
+		Body:    "{{.Name}}同学，你已于{{.Time}}成功报名{{.Course}}{{if .Teacher}}（{{.Teacher}}）{{end}}。",
+	},
+	notifyCancelled: {
+		Subject: "已取消报名：{{.Course}}",
+		Body:    "{{.Name}}同学，你报名的{{.Course}}{{if .Teacher}}（{{.Teacher}}）{{end}}已于{{.Time}}取消。",
+	},
+	notifyLotteryResult: {
+		Subject: "抽签结果：{{.Course}}",
+		Body:    "{{.Name}}同学，报名结果已于{{.Time}}公布，你已被{{.Course}}{{if .Teacher}}（{{.Teacher}}）{{end}}录取。",
+	},
+}
+
+func (self NotifyConfig) withDefaults() NotifyConfig {
+	if self.Queue <= 0 {
+		self.Queue = 10000
+	}
+	if self.Workers <= 0 {
+		self.Workers = 4
+	}
+	if self.MaxRetries <= 0 {
+		self.MaxRetries = 5
+	}
+	if self.Backoff <= 0 {
+		self.Backoff = 5
+	}
+	if self.MaxBackoff <= 0 {
+		self.MaxBackoff = 600
+	}
+	if self.FailedPath == "" {
+		self.FailedPath = "notify-failed.jsonl"
+	}
+	if self.OutboxPath == "" {
+		self.OutboxPath = "notify-outbox.jsonl"
+	}
+	if self.Smtp.Port == 0 {
+		self.Smtp.Port = 25
+	}
+	if self.Wechat.ApiUrl == "" {
+		self.Wechat.ApiUrl = "https://api.weixin.qq.com"
+	}
+	return self
+}
+
+func (self NotifyConfig) template(event string) NotifyTemplate {
+	t := defaultTemplates[event]
+	if v, ok := self.Templates[event]; ok {
+		if v.Subject != "" {
+			t.Subject = v.Subject
+		}
+		if v.Body != "" {
+			t.Body = v.Body
+		}
+		t.Wechat, t.Fields = v.Wechat, v.Fields
+	}
+	return t
+}
+
+//模板中可以使用的字段
+type notifyData struct {
+	School  string
+	Student string
+	Name    string //学生姓名，没有学生资料时为学号
+	Course  string
+	Teacher string
+	Time    string //事件发生的时间，例如2006-01-02 15:04
+}
+
+//发送给一个收件人的一条通知
+type notification struct {
+	Channel   string            `json:"channel"`
+	School    string            `json:"school"`
+	Student   string            `json:"student"`
+	Event     string            `json:"event"`
+	To        string            `json:"to"` //邮箱、手机号或微信openid
+	Subject   string            `json:"subject,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Template  string            `json:"template,omitempty"` //微信订阅消息模板ID
+	Fields    map[string]string `json:"fields,omitempty"`
+	Attempts  int               `json:"attempts"`
+	Error     string            `json:"error,omitempty"`
+	TimeStamp int64             `json:"timestamp"`
+	Due       int64             `json:"due,omitempty"` //下次重试的时间
+}
+
+type notifier interface {
+	//学生资料中本渠道的收件地址，为空表示无法通过本渠道通知
+	address(p *profile) string
+	send(n *notification) error
+}
+
+type notifyEvent struct {
+	s       *school
+	event   string
+	student string
+	course  string
+	teacher string
+	time    time.Time
+}
+
+var notifyConfig NotifyConfig
+var notifiers = map[string]notifier{}
+var notifyEvents chan notifyEvent
+var notifyOutbox *outbox
+
+var notifyQueued int64  //进入发送队列的通知条数
+var notifySent int64    //发送成功的条数
+var notifyRetries int64 //发送失败后重试的次数
+var notifyFailed int64  //重试后仍然失败的条数
+var notifyDropped int64 //队列已满时丢弃的事件数，以及转入失败文件的通知数
+
+//按配置启用通知渠道，没有配置任何渠道时不启动发送协程，notify直接返回
+func startNotifiers(cfg NotifyConfig) {
+	notifyConfig = cfg.withDefaults()
+	if notifyConfig.Smtp.Host != "" {
+		notifiers[channelEmail] = &smtpNotifier{cfg: notifyConfig.Smtp}
+	}
+	if notifyConfig.Sms.Url != "" {
+		notifiers[channelSms] = &smsNotifier{cfg: notifyConfig.Sms}
+	}
+	if notifyConfig.Wechat.AppId != "" {
+		notifiers[channelWechat] = &wechatNotifier{cfg: notifyConfig.Wechat}
+	}
+	if len(notifiers) == 0 {
+		return
+	}
+
+	notifyEvents = make(chan notifyEvent, notifyConfig.Queue)
+	notifyOutbox = newOutbox(notifyConfig.Queue)
+	if n, err := notifyOutbox.load(notifyConfig.OutboxPath); err != nil {
+		log.Println("notify:", err)
+	} else if n > 0 {
+		ColorGreen(fmt.Sprintf("继续发送上次停止服务时没有发送的%d条通知", n))
+	}
+	go notifyRoutine()
+	for i := 0; i < notifyConfig.Workers; i++ {
+		go outboxRoutine()
+	}
+	go RegisterTHandler(&NotifyRetryHandler{})
+}
+
+//报名结果发生变化时调用，不等待发送，可以在持有锁时调用
+func (s *school) notify(event, student string, v *courseObj) {
+	if notifyEvents == nil {
+		return
+	}
+	select {
+	case notifyEvents <- notifyEvent{s, event, student, v.c.Name, v.c.Teacher, time.Now()}:
+	default:
+		atomic.AddInt64(&notifyDropped, 1)
+	}
+}
+
+//读取学生资料并生成各渠道的通知，读取资料可能访问数据库，不在报名的协程中进行
+func notifyRoutine() {
+	for e := range notifyEvents {
+		p, ok := e.s.cachedProfile(e.student)
+		if !ok {
+			if profile, err := e.s.getStudentProfile(e.student); err == nil {
+				p = &profile
+			}
+		}
+		if p == nil {
+			continue
+		}
+		for _, n := range renderNotifications(e, p) {
+			atomic.AddInt64(&notifyQueued, 1)
+			//队列已满时不等待，转入失败文件
+			if !notifyOutbox.push(n) {
+				atomic.AddInt64(&notifyDropped, 1)
+				n.Error = "outbox full"
+				if err := appendFailedNotification(n); err != nil {
+					log.Println("notify:", err)
+				}
+			}
+		}
+	}
+}
+
+func renderNotifications(e notifyEvent, p *profile) []*notification {
+	t := notifyConfig.template(e.event)
+	data := notifyData{School: e.s.name, Student: e.student, Name: p.Name,
+		Course: e.course, Teacher: e.teacher, Time: e.time.Format("2006-01-02 15:04")}
+	if data.Name == "" {
+		data.Name = e.student
+	}
+
+	result := []*notification{}
+	for channel, v := range notifiers {
+		to := v.address(p)
+		if to == "" || (channel == channelWechat && t.Wechat == "") {
+			continue
+		}
+		n := &notification{Channel: channel, School: e.s.name, Student: e.student,
+			Event: e.event, To: to, TimeStamp: e.time.Unix()}
+		var err error
+		switch channel {
+		case channelEmail:
+			n.Subject, err = renderText(t.Subject, data)
+			if err == nil {
+				n.Body, err = renderText(t.Body, data)
+			}
+		case channelSms:
+			n.Body, err = renderText(t.Body, data)
+		case channelWechat:
+			n.Template, n.Fields = t.Wechat, map[string]string{}
+			for k, f := range t.Fields {
+				if n.Fields[k], err = renderText(f, data); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("notify template %s: %v", e.event, err)
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+func renderText(text string, data notifyData) (string, error) {
+	t, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+//等待发送的通知。发送失败的通知记下重试时间放入waiting，由NotifyRetryHandler
+//每秒把到期的移回ready，不为每次重试启动协程
+type outbox struct {
+	m       sync.Mutex
+	cond    *sync.Cond
+	ready   []*notification
+	waiting []*notification
+	sending int  //正在发送的条数
+	max     int  //ready和waiting合计的上限
+	stopped bool //停止服务时不再发送，剩下的通知保存到文件中
+}
+
+func newOutbox(max int) *outbox {
+	self := &outbox{ready: []*notification{}, waiting: []*notification{}, max: max}
+	self.cond = sync.NewCond(&self.m)
+	return self
+}
+
+//队列已满或已经停止时返回false，不等待
+func (self *outbox) push(n *notification) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+	if self.stopped {
+		self.saveLate(n)
+		return true
+	}
+	if len(self.ready)+len(self.waiting) >= self.max {
+		return false
+	}
+	self.ready = append(self.ready, n)
+	self.cond.Signal()
+	return true
+}
+
+//取出一条通知，没有时等待，停止后返回nil
+func (self *outbox) pop() *notification {
+	self.m.Lock()
+	defer self.m.Unlock()
+	for len(self.ready) == 0 && !self.stopped {
+		self.cond.Wait()
+	}
+	if self.stopped {
+		return nil
+	}
+	n := self.ready[0]
+	self.ready[0] = nil
+	self.ready = self.ready[1:]
+	self.sending += 1
+	return n
+}
+
+//发送失败的通知按指数退避等待重试，超过重试次数后追加到失败文件中
+func (self *outbox) finish(n *notification, err error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.sending -= 1
+	if err == nil {
+		atomic.AddInt64(&notifySent, 1)
+		return
+	}
+
+	n.Attempts += 1
+	n.Error = err.Error()
+	if n.Attempts > notifyConfig.MaxRetries {
+		atomic.AddInt64(&notifyFailed, 1)
+		if e := appendFailedNotification(n); e != nil {
+			log.Println("notify:", e)
+		}
+		return
+	}
+	atomic.AddInt64(&notifyRetries, 1)
+	backoff := notifyConfig.Backoff << uint(n.Attempts-1)
+	if backoff > notifyConfig.MaxBackoff || backoff <= 0 {
+		backoff = notifyConfig.MaxBackoff
+	}
+	n.Due = time.Now().Unix() + int64(backoff)
+	if self.stopped {
+		self.saveLate(n)
+		return
+	}
+	self.waiting = append(self.waiting, n)
+}
+
+//已经停止并保存过队列时单独追加到文件中
+func (self *outbox) saveLate(n *notification) {
+	if err := appendNotifications(notifyConfig.OutboxPath, []*notification{n}); err != nil {
+		log.Println("notify:", err)
+	}
+}
+
+//把到期的重试移回ready
+func (self *outbox) schedule(now int64) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	waiting := self.waiting[:0]
+	for _, n := range self.waiting {
+		if n.Due <= now {
+			self.ready = append(self.ready, n)
+			self.cond.Signal()
+		} else {
+			waiting = append(waiting, n)
+		}
+	}
+	for i := len(waiting); i < len(self.waiting); i++ {
+		self.waiting[i] = nil
+	}
+	self.waiting = waiting
+}
+
+func (self *outbox) pending() int {
+	self.m.Lock()
+	defer self.m.Unlock()
+	return len(self.ready) + len(self.waiting) + self.sending
+}
+
+//停止发送，把没有发送的通知保存到path中，返回保存的条数
+func (self *outbox) stop(path string) (int, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	self.stopped = true
+	self.cond.Broadcast()
+	remaining := append(self.ready, self.waiting...)
+	self.ready, self.waiting = nil, nil
+	return len(remaining), appendNotifications(path, remaining)
+}
+
+//读取上次停止服务时保存的通知，读取后删除文件
+func (self *outbox) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	self.m.Lock()
+	defer self.m.Unlock()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		n := &notification{}
+		if err := json.Unmarshal(scanner.Bytes(), n); err != nil {
+			return count, err
+		}
+		if n.Due > 0 {
+			self.waiting = append(self.waiting, n)
+		} else {
+			self.ready = append(self.ready, n)
+		}
+		count++
+	}
+	return count, scanner.Err()
+}
+
+func outboxRoutine() {
+	for {
+		n := notifyOutbox.pop()
+		if n == nil {
+			return
+		}
+		notifyOutbox.finish(n, notifiers[n.Channel].send(n))
+	}
+}
+
+type NotifyRetryHandler struct{}
+
+func (self *NotifyRetryHandler) handle() int {
+	notifyOutbox.schedule(time.Now().Unix())
+	return Continue()
+}
+
+//停止服务时调用，等待已经发生的事件生成通知并发送完，超时后把剩下的通知
+//保存到文件中，下次启动时继续发送
+func drainNotify(timeout time.Duration) {
+	if notifyOutbox == nil {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	for (len(notifyEvents) > 0 || notifyOutbox.pending() > 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	n, err := notifyOutbox.stop(notifyConfig.OutboxPath)
+	if err != nil {
+		ColorRed(fmt.Sprintf("%d条通知未能保存：%v", n, err))
+	} else if n > 0 {
+		fmt.Printf("%d条通知没有发送，下次启动时继续发送\n", n)
+	}
+}
+
+var mutexNotifyFailed sync.Mutex
+
+func appendFailedNotification(n *notification) error {
+	return appendNotifications(notifyConfig.FailedPath, []*notification{n})
+}
+
+func appendNotifications(path string, notifications []*notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	mutexNotifyFailed.Lock()
+	defer mutexNotifyFailed.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, n := range notifications {
+		b, _ := json.Marshal(n)
+		if _, err = f.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func pendingNotifications() int {
+	if notifyOutbox == nil {
+		return 0
+	}
+	return notifyOutbox.pending()
+}
+
+//通知的发送情况
+func handleNotifyStats(w http.ResponseWriter, r *http.Request) {
+	channels := []string{}
+	for k := range notifiers {
+		channels = append(channels, k)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"channels": channels,
+		"queued":   atomic.LoadInt64(&notifyQueued),
+		"sent":     atomic.LoadInt64(&notifySent),
+		"retries":  atomic.LoadInt64(&notifyRetries),
+		"failed":   atomic.LoadInt64(&notifyFailed),
+		"dropped":  atomic.LoadInt64(&notifyDropped),
+		"pending":  pendingNotifications(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+type smtpNotifier struct {
+	cfg SmtpConfig
+}
+
+func (self *smtpNotifier) address(p *profile) string {
+	return p.Email
+}
+
+//服务器支持STARTTLS时smtp.SendMail会自动加密连接
+func (self *smtpNotifier) send(n *notification) error {
+	var auth smtp.Auth
+	if self.cfg.Username != "" {
+		auth = smtp.PlainAuth("", self.cfg.Username, self.cfg.Password, self.cfg.Host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: 8bit\r\n\r\n%s\r\n",
+		self.cfg.From, n.To, mime.BEncoding.Encode("UTF-8", n.Subject),
+		time.Now().Format(time.RFC1123Z), strings.Replace(n.Body, "\n", "\r\n", -1))
+	return smtp.SendMail(fmt.Sprintf("%s:%d", self.cfg.Host, self.cfg.Port), auth,
+		self.cfg.From, []string{n.To}, []byte(msg))
+}
+
+var notifyHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+type smsNotifier struct {
+	cfg SmsConfig
+}
+
+func (self *smsNotifier) address(p *profile) string {
+	return p.Phone
+}
+
+func (self *smsNotifier) send(n *notification) error {
+	b, _ := json.Marshal(map[string]string{"phone": n.To, "text": self.cfg.Sign + n.Body})
+	req, err := http.NewRequest(http.MethodPost, self.cfg.Url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if self.cfg.Key != "" {
+		req.Header.Set("Authorization", "Bearer "+self.cfg.Key)
+	}
+	resp, err := notifyHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("sms gateway: %s %s", resp.Status, body)
+	}
+	return nil
+}
+
+//微信小程序订阅消息，学生需要先在小程序中订阅对应的模板
+type wechatNotifier struct {
+	cfg     WechatConfig
+	m       sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (self *wechatNotifier) address(p *profile) string {
+	return p.OpenId
+}
+
+//access_token有效期2小时，提前5分钟重新获取
+func (self *wechatNotifier) accessToken() (string, error) {
+	self.m.Lock()
+	defer self.m.Unlock()
+	if self.token != "" && time.Now().Before(self.expires) {
+		return self.token, nil
+	}
+
+	url := fmt.Sprintf("%s/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s",
+		self.cfg.ApiUrl, self.cfg.AppId, self.cfg.Secret)
+	resp, err := notifyHttpClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		ErrCode     int    `json:"errcode"`
+		ErrMsg      string `json:"errmsg"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("wechat token: %d %s", result.ErrCode, result.ErrMsg)
+	}
+	self.token = result.AccessToken
+	self.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - 5*time.Minute)
+	return self.token, nil
+}
+
+func (self *wechatNotifier) send(n *notification) error {
+	token, err := self.accessToken()
+	if err != nil {
+		return err
+	}
+	data := map[string]map[string]string{}
+	for k, v := range n.Fields {
+		data[k] = map[string]string{"value": v}
+	}
+	b, _ := json.Marshal(map[string]interface{}{"touser": n.To, "template_id": n.Template,
+		"page": self.cfg.Page, "data": data})
+	resp, err := notifyHttpClient.Post(
+		self.cfg.ApiUrl+"/cgi-bin/message/subscribe/send?access_token="+token,
+		"application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	result := struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	switch result.ErrCode {
+	case 0:
+		return nil
+	case 40001, 42001: //access_token无效或过期，下次重试时重新获取
+		self.m.Lock()
+		self.token = ""
+		self.m.Unlock()
+	}
+	return fmt.Errorf("wechat send: %d %s", result.ErrCode, result.ErrMsg)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//用notify-sink代替短信网关和微信接口
+func startTestSink(t *testing.T, fail int) *notifySink {
+	sink := &notifySink{messages: []sinkMessage{}, fail: fail}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sms", sink.handleSms)
+	mux.HandleFunc("/cgi-bin/token", sink.handleWechatToken)
+	mux.HandleFunc("/cgi-bin/message/subscribe/send", sink.handleWechatSend)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	savedConfig, savedNotifiers := notifyConfig, notifiers
+	t.Cleanup(func() { notifyConfig, notifiers = savedConfig, savedNotifiers })
+	notifyConfig = NotifyConfig{
+		Sms:        SmsConfig{Url: server.URL + "/sms", Sign: "【测试】"},
+		Wechat:     WechatConfig{AppId: "test", ApiUrl: server.URL},
+		MaxRetries: 2,
+		Backoff:    5,
+		MaxBackoff: 8,
+		FailedPath: filepath.Join(dir, "failed.jsonl"),
+		OutboxPath: filepath.Join(dir, "outbox.jsonl"),
+		Templates: map[string]NotifyTemplate{notifyRegistered: {Wechat: "template",
+			Fields: map[string]string{"thing1": "{{.Course}}"}}},
+	}.withDefaults()
+	notifiers = map[string]notifier{
+		channelSms:    &smsNotifier{cfg: notifyConfig.Sms},
+		channelWechat: &wechatNotifier{cfg: notifyConfig.Wechat},
+	}
+	return sink
+}
+
+func testNotifications(t *testing.T) (*notification, *notification) {
+	e := notifyEvent{&school{name: "test"}, notifyRegistered, "1001", "围棋", "王老师",
+		time.Date(2026, 9, 1, 8, 30, 0, 0, time.Local)}
+	var sms, wechat *notification
+	for _, n := range renderNotifications(e, &profile{Name: "张三", Phone: "13800000000",
+		OpenId: "openid"}) {
+		switch n.Channel {
+		case channelSms:
+			sms = n
+		case channelWechat:
+			wechat = n
+		}
+	}
+	if sms == nil || wechat == nil {
+		t.Fatal("missing sms or wechat notification")
+	}
+	return sms, wechat
+}
+
+//取出一条发送，返回发送后的通知
+func sendOne(q *outbox) *notification {
+	n := q.pop()
+	q.finish(n, notifiers[n.Channel].send(n))
+	return n
+}
+
+func TestRenderNotifications(t *testing.T) {
+	startTestSink(t, 0)
+	sms, wechat := testNotifications(t)
+	if sms.To != "13800000000" || sms.Body != "张三同学，你已于2026-09-01 08:30成功报名围棋（王老师）。" {
+		t.Errorf("sms: %s %s", sms.To, sms.Body)
+	}
+	if wechat.To != "openid" || wechat.Template != "template" || wechat.Fields["thing1"] != "围棋" {
+		t.Errorf("wechat: %s %s %v", wechat.To, wechat.Template, wechat.Fields)
+	}
+}
+
+//前两次发送失败，按5秒、8秒（10秒超过上限）退避后第三次发送成功
+func TestNotifyRetryBackoff(t *testing.T) {
+	sink := startTestSink(t, 2)
+	sms, _ := testNotifications(t)
+	q := newOutbox(10)
+	q.push(sms)
+
+	for i, backoff := range []int64{5, 8} {
+		now := time.Now().Unix()
+		n := sendOne(q)
+		if n.Attempts != i+1 || n.Due < now+backoff || n.Due > now+backoff+1 {
+			t.Fatalf("attempt %d: attempts %d, due in %d seconds", i+1, n.Attempts, n.Due-now)
+		}
+		q.schedule(n.Due - 1)
+		if len(q.ready) != 0 {
+			t.Fatalf("attempt %d: retried before due", i+1)
+		}
+		q.schedule(n.Due)
+	}
+
+	sendOne(q)
+	if q.pending() != 0 || len(sink.messages) != 1 ||
+		sink.messages[0].Content != "【测试】"+sms.Body {
+		t.Fatalf("pending %d, messages %v", q.pending(), sink.messages)
+	}
+}
+
+//超过重试次数后写入失败文件
+func TestNotifyFailed(t *testing.T) {
+	startTestSink(t, 10)
+	_, wechat := testNotifications(t)
+	q := newOutbox(10)
+	q.push(wechat)
+	for i := 0; i <= notifyConfig.MaxRetries; i++ {
+		n := sendOne(q)
+		q.schedule(n.Due)
+	}
+
+	b, err := ioutil.ReadFile(notifyConfig.FailedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.pending() != 0 || strings.Count(string(b), "\n") != 1 {
+		t.Fatalf("pending %d, failed %s", q.pending(), b)
+	}
+}
+
+//停止时保存没有发送的通知，下次启动时读取
+func TestOutboxStopLoad(t *testing.T) {
+	startTestSink(t, 1)
+	sms, wechat := testNotifications(t)
+	q := newOutbox(1)
+	if !q.push(sms) || q.push(wechat) {
+		t.Fatal("outbox limit")
+	}
+	sendOne(q)
+	if n, err := q.stop(notifyConfig.OutboxPath); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if q.pop() != nil {
+		t.Fatal("pop after stop")
+	}
+
+	loaded := newOutbox(10)
+	if n, err := loaded.load(notifyConfig.OutboxPath); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if len(loaded.waiting) != 1 || loaded.waiting[0].Attempts != 1 {
+		t.Fatalf("waiting %v", loaded.waiting)
+	}
+	if _, err := os.Stat(notifyConfig.OutboxPath); !os.IsNotExist(err) {
+		t.Fatal("outbox file not removed")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//测试用的本地通知接收服务，代替真实的邮件服务器、短信网关和微信接口，
+//收到的通知打印到终端，并可以通过GET /messages取回
+type sinkMessage struct {
+	Channel   string `json:"channel"`
+	To        string `json:"to"`
+	Content   string `json:"content"`
+	TimeStamp int64  `json:"timestamp"`
+}
+
+type notifySink struct {
+	m        sync.Mutex
+	messages []sinkMessage
+	fail     int //之后的多少个请求返回失败，用于测试重试
+}
+
+func (self *notifySink) add(channel, to, content string) bool {
+	self.m.Lock()
+	defer self.m.Unlock()
+	if self.fail > 0 {
+		self.fail -= 1
+		fmt.Printf("[%s] %s 模拟发送失败\n", channel, to)
+		return false
+	}
+	self.messages = append(self.messages, sinkMessage{channel, to, content, time.Now().Unix()})
+	fmt.Printf("[%s] %s\n%s\n\n", channel, to, content)
+	return true
+}
+
+//只实现smtp.SendMail用到的命令，不支持STARTTLS和AUTH
+func (self *notifySink) serveSmtp(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	r := bufio.NewReader(conn)
+	reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+
+	reply("220 notify-sink")
+	to := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 notify-sink")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			to = []string{}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			to = append(to, strings.Trim(strings.TrimSpace(line[len("RCPT TO:"):]), "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			data := strings.Builder{}
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" || line == ".\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			if self.add(channelEmail, strings.Join(to, ","), data.String()) {
+				reply("250 OK")
+			} else {
+				reply("451 Requested action aborted")
+			}
+		case command == "RSET", command == "NOOP":
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (self *notifySink) handleSms(w http.ResponseWriter, r *http.Request) {
+	sms := struct {
+		Phone string `json:"phone"`
+		Text  string `json:"text"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&sms); err != nil || sms.Phone == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !self.add(channelSms, sms.Phone, sms.Text) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func (self *notifySink) handleWechatToken(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"access_token":"notify-sink","expires_in":7200}`))
+}
+
+func (self *notifySink) handleWechatSend(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	msg := struct {
+		ToUser string `json:"touser"`
+	}{}
+	json.Unmarshal(b, &msg)
+	if !self.add(channelWechat, msg.ToUser, string(b)) {
+		w.Write([]byte(`{"errcode":-1,"errmsg":"system busy"}`))
+		return
+	}
+	w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+}
+
+func (self *notifySink) handleMessages(w http.ResponseWriter, r *http.Request) {
+	self.m.Lock()
+	b, _ := json.Marshal(self.messages)
+	self.m.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+//notify.smtp.host、notify.sms.url和notify.wechat.api_url分别指向本服务即可，例如：
+//smtp: {host: localhost, port: 2525}，sms: {url: http://localhost:8025/sms}，
+//wechat: {app_id: test, api_url: http://localhost:8025}
+func runNotifySink(args []string) {
+	flags := flag.NewFlagSet("notify-sink", flag.ExitOnError)
+	smtpAddr := flags.String("smtp", "localhost:2525", "address of the SMTP stand-in")
+	httpAddr := flags.String("http", "localhost:8025", "address of the SMS and WeChat stand-in")
+	fail := flags.Int("fail", 0, "number of deliveries to reject before accepting")
+	flags.Parse(args)
+
+	sink := &notifySink{messages: []sinkMessage{}, fail: *fail}
+	l, err := net.Listen("tcp", *smtpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Fatal(err)
+			}
+			go sink.serveSmtp(conn)
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sms", sink.handleSms)
+	mux.HandleFunc("/cgi-bin/token", sink.handleWechatToken)
+	mux.HandleFunc("/cgi-bin/message/subscribe/send", sink.handleWechatSend)
+	mux.HandleFunc("/messages", sink.handleMessages)
+	fmt.Printf("SMTP: %s，短信和微信: http://%s\n", *smtpAddr, *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, mux))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//家长资料与学生资料保存在同一个数据库中，一个家长可以关联多个学生
+type parent struct {
+	Parent   string   `json:"parent"` //家长编号，通常为手机号
+	Name     string   `json:"name"`
+	Phone    string   `json:"-"`
+	OpenId   string   `json:"-"` //微信小程序的openid，用于/authorize登录
+	Students []string `json:"students"`
+}
+
+//家长的令牌与学生的令牌格式相同，学号的位置为parent:家长编号，
+//审计记录的操作者也使用这个格式
+const parentPrefix = "parent:"
+
+func (self *parent) linked(student string) bool {
+	for _, v := range self.Students {
+		if v == student {
+			return true
+		}
+	}
+	return false
+}
+
+type parentEntry struct {
+	p       *parent
+	expires time.Time
+}
+
+//家长资料和学生资料一样缓存，报名期间家长代报名不必每次访问数据库。
+//只缓存存在的家长，过期或加载课程后重新读取，修改的关联在profileTtl内生效
+func (s *school) getParent(id string) (*parent, error) {
+	s.mutexProfiles.Lock()
+	e, ok := s.parents[id]
+	if ok && time.Now().After(e.expires) {
+		delete(s.parents, id)
+		ok = false
+	}
+	s.mutexProfiles.Unlock()
+	if ok {
+		return e.p, nil
+	}
+
+	v, err := dbClient.getParent(s.name, "parent", id)
+	if err != nil {
+		return nil, err
+	}
+	s.mutexProfiles.Lock()
+	s.parents[id] = parentEntry{&v, time.Now().Add(profileTtl)}
+	s.mutexProfiles.Unlock()
+	return &v, nil
+}
+
+//返回令牌对应的家长，没有令牌或不是家长的令牌时返回nil
+func (s *school) requestParent(r *http.Request) *parent {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	subject := s.verifyToken(token)
+	if !strings.HasPrefix(subject, parentPrefix) {
+		return nil
+	}
+	p, err := s.getParent(strings.TrimPrefix(subject, parentPrefix))
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+//返回为student操作的人：管理员为admin，家长代为操作时为parent:家长编号，学生本人为学号。
+//请求没有学生本人、关联家长的令牌，也不是管理员时返回false
+func (s *school) actor(r *http.Request, student string) (string, bool) {
+	if !s.authorized(r, student) {
+		return "", false
+	}
+	if isAdmin(r) {
+		return actorAdmin, true
+	}
+	if p := s.requestParent(r); p != nil {
+		return parentPrefix + p.Parent, true
+	}
+	return student, true
+}
+
+const (
+	loginCodeTtl      = 5 * time.Minute
+	loginCodeInterval = time.Minute //同一家长重新发送验证码的最短间隔
+	loginCodeAttempts = 5           //输错次数达到后验证码作废
+)
+
+type loginCode struct {
+	code     string
+	sent     time.Time
+	attempts int
+}
+
+//家长用编号登录时先向家长的手机发送验证码，家长不存在时返回相同的结果，
+//不能用来探测家长编号和关联的学生
+func (s *school) sendLoginCode(id string) (int, string) {
+	if _, ok := notifiers[channelSms]; !ok || notifyOutbox == nil {
+		return 1, "没有配置短信，请使用微信小程序登录"
+	}
+	p, err := s.getParent(id)
+	if err != nil || p.Phone == "" {
+		return 0, "验证码已发送"
+	}
+
+	now := time.Now()
+	s.mutexProfiles.Lock()
+	for k, v := range s.loginCodes {
+		if now.Sub(v.sent) > loginCodeTtl {
+			delete(s.loginCodes, k)
+		}
+	}
+	if v, ok := s.loginCodes[id]; ok && now.Sub(v.sent) < loginCodeInterval {
+		s.mutexProfiles.Unlock()
+		return 0, "验证码已发送"
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(1000000))
+	code := fmt.Sprintf("%06d", n.Int64())
+	s.loginCodes[id] = &loginCode{code: code, sent: now}
+	s.mutexProfiles.Unlock()
+
+	notifyOutbox.push(&notification{Channel: channelSms, School: s.name, Event: "login-code",
+		To: p.Phone, TimeStamp: now.Unix(), Body: fmt.Sprintf("家长登录验证码：%s，%d分钟内有效。",
+			code, int(loginCodeTtl/time.Minute))})
+	return 0, "验证码已发送"
+}
+
+//验证码正确时作废并返回true
+func (s *school) checkLoginCode(id, code string) bool {
+	s.mutexProfiles.Lock()
+	defer s.mutexProfiles.Unlock()
+	v, ok := s.loginCodes[id]
+	if !ok {
+		return false
+	}
+	if time.Since(v.sent) > loginCodeTtl {
+		delete(s.loginCodes, id)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(v.code), []byte(code)) != 1 {
+		v.attempts += 1
+		if v.attempts >= loginCodeAttempts {
+			delete(s.loginCodes, id)
+		}
+		return false
+	}
+	delete(s.loginCodes, id)
+	return true
+}
+
+//家长用编号登录分两步：没有code时发送验证码，有code时验证后返回令牌和关联的学生
+func (s *school) handleParentLogin(w http.ResponseWriter, r *http.Request, id string) {
+	code := r.FormValue("code")
+	if len(r.Form) == 2 {
+		errCode, errMsg := s.sendLoginCode(id)
+		w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s"}`, errCode, errMsg)))
+		return
+	}
+	if len(r.Form) != 3 || code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.checkLoginCode(id, code) {
+		w.Write([]byte(`{"errCode":1,"errMsg":"验证码错误或已过期"}`))
+		return
+	}
+	p, err := s.getParent(id)
+	s.parentLogin(w, p, err)
+}
+
+//家长通过验证码或微信登录后返回令牌和关联的学生
+func (s *school) parentLogin(w http.ResponseWriter, p *parent, err error) {
+	if err != nil {
+		w.Write([]byte(`{"errCode":1}`))
+		return
+	}
+	children := s.children(p)
+	b, _ := json.Marshal(&children)
+	w.Write([]byte(fmt.Sprintf(`{"errCode":0,"name":"%s","token":"%s","children":%s}`,
+		p.Name, s.issueToken(parentPrefix+p.Parent), b)))
+}
+
+type child struct {
+	Student string `json:"student"`
+	Name    string `json:"name"`
+	Avatar  string `json:"avatar"`
+}
+
+func (s *school) children(p *parent) []child {
+	children := []child{}
+	for _, v := range p.Students {
+		c := child{Student: v}
+		if profile, err := s.getStudentProfile(v); err == nil {
+			c.Name, c.Avatar = profile.Name, signAvatar(profile.Avatar)
+		}
+		children = append(children, c)
+	}
+	return children
+}
+
+//列出家长关联的学生，需要家长的令牌
+func handleChildren(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	p := school.requestParent(r)
+	if p == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	children := school.children(p)
+	b, _ := json.Marshal(&children)
+	w.Write([]byte(fmt.Sprintf(`{"errCode":0,"children":%s}`, b)))
+}
+
+//用微信小程序wx.login得到的code换取openid，再按openid查找家长
+func handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	code := r.FormValue("code")
+	if code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	openId, err := code2Session(code)
+	if err != nil {
+		log.Println("authorize:", err)
+		w.Write([]byte(`{"errCode":1}`))
+		return
+	}
+	p, err := dbClient.getParent(school.name, "openid", openId)
+	school.parentLogin(w, &p, err)
+}
+
+//微信登录使用通知配置中的小程序app_id和secret
+func code2Session(code string) (string, error) {
+	cfg := config.Notify.withDefaults().Wechat
+	if cfg.AppId == "" {
+		return "", fmt.Errorf("wechat app_id not configured")
+	}
+	query := url.Values{"appid": {cfg.AppId}, "secret": {cfg.Secret},
+		"js_code": {code}, "grant_type": {"authorization_code"}}
+	resp, err := notifyHttpClient.Get(cfg.ApiUrl + "/sns/jscode2session?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	result := struct {
+		OpenId  string `json:"openid"`
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if result.OpenId == "" {
+		return "", fmt.Errorf("wechat code2session: %d %s", result.ErrCode, result.ErrMsg)
+	}
+	return result.OpenId, nil
+}
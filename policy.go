@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	cancelAlways   = "always"   //随时可以取消（默认）
+	cancelOpen     = "open"     //只能在报名进行中取消，先到先得模式下为报名开始后window分钟内
+	cancelDeadline = "deadline" //报名开始后到退课截止时间前可以取消
+	cancelDisabled = "disabled" //不允许取消
+)
+
+//取消被拒绝时的错误码，1为其它原因
+const (
+	errCancelNotStarted = 2
+	errCancelClosed     = 3
+	errCancelLimit      = 4
+	errCancelDisabled   = 5
+)
+
+type CancelPolicy struct {
+	Mode     string `yaml:"mode"`
+	Deadline int    `yaml:"deadline"` //deadline模式下报名开始后多少分钟截止退课
+	Max      int    `yaml:"max"`      //每个学生在本次报名中最多取消的次数，0表示不限
+	Window   int    `yaml:"window"`   //先到先得模式下open规则可以取消的分钟数，默认30
+}
+
+func (self CancelPolicy) window() time.Duration {
+	if self.Window <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(self.Window) * time.Minute
+}
+
+func (self CancelPolicy) validate() error {
+	switch self.Mode {
+	case "", cancelAlways, cancelOpen, cancelDisabled:
+	case cancelDeadline:
+		if self.Deadline <= 0 {
+			return fmt.Errorf("cancel.deadline must be positive in deadline mode")
+		}
+	default:
+		return fmt.Errorf("unknown cancel.mode %q", self.Mode)
+	}
+	if self.Max < 0 {
+		return fmt.Errorf("cancel.max must not be negative")
+	}
+	if self.Window < 0 {
+		return fmt.Errorf("cancel.window must not be negative")
+	}
+	return nil
+}
+
+//检查学生现在能否取消报名，返回0表示可以，调用者需持有s.m和学生所在分片的锁
+func (s *school) checkCancel(student string) (int, string) {
+	policy := s.sessionConfig().Cancel
+	switch policy.Mode {
+	case cancelDisabled:
+		return errCancelDisabled, "本次报名不允许取消"
+	case cancelOpen:
+		if !s.started {
+			return errCancelNotStarted, "报名未开始"
+		}
+		//先到先得模式没有截止操作，按取消规则的window计算报名结束的时间
+		if s.closed || (s.mode != modeLottery && s.mode != modeRanked &&
+			time.Now().After(s.startTime.Add(policy.window()))) {
+			return errCancelClosed, "报名已结束，不能取消"
+		}
+	case cancelDeadline:
+		if !s.started {
+			return errCancelNotStarted, "报名未开始"
+		}
+		deadline := s.startTime.Add(time.Duration(policy.Deadline) * time.Minute)
+		if time.Now().After(deadline) {
+			return errCancelClosed, "已过退课截止时间"
+		}
+	case cancelAlways, "":
+	default:
+		//配置加载时已经检查，这里不允许未知的规则放行取消
+		return errCancelDisabled, "本次报名不允许取消"
+	}
+
+	if policy.Max > 0 && s.shard(student).cancels[student] >= policy.Max {
+		return errCancelLimit, fmt.Sprintf("最多只能取消%d次", policy.Max)
+	}
+	return 0, ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type quota struct {
+	Grade int `json:"grade"`
+	Max   int `json:"max"`
+}
+
+//解析sql数据库中的年级名额，格式为"年级:人数"，用逗号分隔，例如：1:10,2:15
+func parseGradeQuota(s string) ([]quota, error) {
+	quotas := []quota{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		q := strings.SplitN(v, ":", 2)
+		if len(q) != 2 {
+			return nil, fmt.Errorf("invalid grade quota: %s", s)
+		}
+		grade, err1 := strconv.Atoi(strings.TrimSpace(q[0]))
+		max, err2 := strconv.Atoi(strings.TrimSpace(q[1]))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid grade quota: %s", s)
+		}
+		quotas = append(quotas, quota{grade, max})
+	}
+	return quotas, nil
+}
+
+//学生所在的年级和班级，用于按年级、班级限制名额
+type studentInfo struct {
+	Grade int
+	Class string
+}
+
+//班级编号只在年级内唯一
+func (self studentInfo) classKey() string {
+	return fmt.Sprintf("%d-%s", self.Grade, self.Class)
+}
+
+func (self course) gradeQuota(grade int) (int, bool) {
+	for _, v := range self.GradeQuota {
+		if v.Grade == grade {
+			return v.Max, true
+		}
+	}
+	return 0, false
+}
+
+//返回info所在年级、班级还能报名的人数，调用者需持有s.m写锁或课程的锁
+func (self *courseObj) remaining(info studentInfo) int {
+	n := self.c.Total - self.c.Number
+	if max, ok := self.c.gradeQuota(info.Grade); ok && max-self.gradeCount[info.Grade] < n {
+		n = max - self.gradeCount[info.Grade]
+	}
+	if self.c.ClassQuota > 0 && info.Class != "" &&
+		self.c.ClassQuota-self.classCount[info.classKey()] < n {
+		n = self.c.ClassQuota - self.classCount[info.classKey()]
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+//返回空字符串表示还有名额，否则返回已满的原因
+func (self *courseObj) full(info studentInfo) string {
+	if self.c.Number >= self.c.Total {
+		return "已报满"
+	}
+	if max, ok := self.c.gradeQuota(info.Grade); ok && self.gradeCount[info.Grade] >= max {
+		return "本年级名额已满"
+	}
+	if self.c.ClassQuota > 0 && info.Class != "" &&
+		self.classCount[info.classKey()] >= self.c.ClassQuota {
+		return "本班名额已满"
+	}
+	return ""
+}
+
+func (self *courseObj) add(student string, info studentInfo) {
+	self.c.Number += 1
+	self.students[student] = info
+	self.gradeCount[info.Grade] += 1
+	if info.Class != "" {
+		self.classCount[info.classKey()] += 1
+	}
+}
+
+func (self *courseObj) remove(student string) bool {
+	info, ok := self.students[student]
+	if !ok {
+		return false
+	}
+	self.c.Number -= 1
+	delete(self.students, student)
+	self.gradeCount[info.Grade] -= 1
+	if info.Class != "" {
+		self.classCount[info.classKey()] -= 1
+	}
+	return true
+}
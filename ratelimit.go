@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateConfig struct {
+	Rate  float64 `yaml:"rate"`  //每秒补充的令牌数，0表示不限制
+	Burst int     `yaml:"burst"` //令牌桶容量，即允许的瞬时请求数
+}
+
+type RateLimitConfig struct {
+	Student RateConfig `yaml:"student"` //每个学生
+	IP      RateConfig `yaml:"ip"`      //每个客户端IP
+	Global  RateConfig `yaml:"global"`  //所有请求合计
+}
+
+func (self RateConfig) enabled() bool {
+	return self.Rate > 0
+}
+
+func (self RateConfig) capacity() float64 {
+	if self.Burst < 1 {
+		return 1
+	}
+	return float64(self.Burst)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg RateConfig, now time.Time) *tokenBucket {
+	return &tokenBucket{cfg.capacity(), now}
+}
+
+func (self *tokenBucket) refill(cfg RateConfig, now time.Time) {
+	self.tokens = math.Min(cfg.capacity(),
+		self.tokens+now.Sub(self.last).Seconds()*cfg.Rate)
+	self.last = now
+}
+
+//返回还需要等待多久才有可用令牌，0表示当前可用
+func (self *tokenBucket) wait(cfg RateConfig) time.Duration {
+	if self.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - self.tokens) / cfg.Rate * float64(time.Second))
+}
+
+type rateCounter struct {
+	Allowed int64 `json:"allowed"`
+	Student int64 `json:"rejectedStudent"`
+	IP      int64 `json:"rejectedIp"`
+	Global  int64 `json:"rejectedGlobal"`
+}
+
+type rateLimiter struct {
+	m        sync.Mutex
+	cfg      RateLimitConfig
+	global   *tokenBucket
+	ips      map[string]*tokenBucket
+	students map[string]*tokenBucket
+	counters map[string]*rateCounter //按接口统计
+}
+
+var limiter = &rateLimiter{
+	ips:      map[string]*tokenBucket{},
+	students: map[string]*tokenBucket{},
+	counters: map[string]*rateCounter{},
+}
+
+func (self *rateLimiter) configure(cfg RateLimitConfig) {
+	self.m.Lock()
+	self.cfg = cfg
+	self.global = newTokenBucket(cfg.Global, time.Now())
+	self.ips = map[string]*tokenBucket{}
+	self.students = map[string]*tokenBucket{}
+	self.m.Unlock()
+
+	if cfg.Student.enabled() || cfg.IP.enabled() {
+		RegisterTHandler(&rateLimitSweeper{self, 0})
+	}
+}
+
+func (self *rateLimiter) bucket(buckets map[string]*tokenBucket, key string,
+	cfg RateConfig, now time.Time) *tokenBucket {
+
+	b, ok := buckets[key]
+	if !ok {
+		b = newTokenBucket(cfg, now)
+		buckets[key] = b
+		return b
+	}
+	b.refill(cfg, now)
+	return b
+}
+
+//只有学生、IP和全局三个令牌桶都有可用令牌时才扣除令牌，
+//避免被某一个限制拒绝的请求消耗其余桶的令牌
+func (self *rateLimiter) allow(endpoint, student, ip string) (bool, time.Duration) {
+	now := time.Now()
+	self.m.Lock()
+	defer self.m.Unlock()
+
+	counter, ok := self.counters[endpoint]
+	if !ok {
+		counter = &rateCounter{}
+		self.counters[endpoint] = counter
+	}
+
+	type check struct {
+		cfg      RateConfig
+		b        *tokenBucket
+		rejected *int64
+	}
+	checks := make([]check, 0, 3)
+	if self.cfg.Student.enabled() && student != "" {
+		checks = append(checks, check{self.cfg.Student,
+			self.bucket(self.students, student, self.cfg.Student, now), &counter.Student})
+	}
+	if self.cfg.IP.enabled() && ip != "" {
+		checks = append(checks, check{self.cfg.IP,
+			self.bucket(self.ips, ip, self.cfg.IP, now), &counter.IP})
+	}
+	if self.cfg.Global.enabled() {
+		self.global.refill(self.cfg.Global, now)
+		checks = append(checks, check{self.cfg.Global, self.global, &counter.Global})
+	}
+
+	for _, c := range checks {
+		if wait := c.b.wait(c.cfg); wait > 0 {
+			*c.rejected += 1
+			return false, wait
+		}
+	}
+	for _, c := range checks {
+		c.b.tokens -= 1
+	}
+	counter.Allowed += 1
+	return true, 0
+}
+
+//令牌桶已经补满的条目与新建的条目等价，定期清除以免占用内存
+func (self *rateLimiter) sweep() {
+	now := time.Now()
+	self.m.Lock()
+	for _, v := range []struct {
+		buckets map[string]*tokenBucket
+		cfg     RateConfig
+	}{{self.students, self.cfg.Student}, {self.ips, self.cfg.IP}} {
+		for k, b := range v.buckets {
+			b.refill(v.cfg, now)
+			if b.tokens >= v.cfg.capacity() {
+				delete(v.buckets, k)
+			}
+		}
+	}
+	self.m.Unlock()
+}
+
+type rateLimitSweeper struct {
+	l       *rateLimiter
+	seconds int64
+}
+
+func (self *rateLimitSweeper) handle() int {
+	const sweepInterval = 60
+	self.seconds += 1
+	if self.seconds%sweepInterval == 0 {
+		self.l.sweep()
+	}
+	return Continue()
+}
+
+func rateLimited(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		//解析失败的请求交给h返回400
+		student := ""
+		if r.ParseForm() == nil && r.FormValue("student") != "" {
+			student = r.FormValue("school") + "/" + r.FormValue("student")
+		}
+
+		ok, wait := limiter.allow(endpoint, student, clientIP(r))
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func handleRateLimitStats(w http.ResponseWriter, r *http.Request) {
+	stats := struct {
+		Students int                     `json:"students"`
+		IPs      int                     `json:"ips"`
+		Data     map[string]*rateCounter `json:"data"`
+	}{Data: map[string]*rateCounter{}}
+
+	limiter.m.Lock()
+	stats.Students = len(limiter.students)
+	stats.IPs = len(limiter.ips)
+	for k, v := range limiter.counters {
+		c := *v
+		stats.Data[k] = &c
+	}
+	limiter.m.Unlock()
+
+	b, _ := json.Marshal(&stats)
+	w.Write(b)
+}
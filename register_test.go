@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testDbOnce sync.Once
+
+//测试不连接数据库，写入队列由nullDb直接丢弃，配置了shared_seats的学校预留名额时延迟1毫秒
+func newTestSchool(name string, courses, total int) *school {
+	testDbOnce.Do(func() {
+		dbClient = seatLatencyDb{delay: time.Millisecond}
+		startDbWriters(config.DbWriter)
+	})
+
+	s := getSchool(name)
+	s.m.Lock()
+	s.courses = make([]*courseObj, courses)
+	for i := range s.courses {
+		s.courses[i] = NewCourseObj(course{Name: fmt.Sprintf("course-%d", i),
+			Teacher: "teacher", Total: total, Grade: []int{1}})
+	}
+	s.courseTag, s.table, s.mode = "test", "test", modeFcfs
+	s.started, s.startTime, s.closed = true, time.Now(), false
+	s.resetShards()
+	s.m.Unlock()
+	return s
+}
+
+//同一学生同时提交多个报名请求，报名人数不超过名额，每个学生最多报一门课
+func TestRegisterConcurrent(t *testing.T) {
+	const courses, total, students = 8, 50, 1000
+	s := newTestSchool("test-concurrent", courses, total)
+
+	wg := sync.WaitGroup{}
+	var registered int64
+	for i := 0; i < students; i++ {
+		student := strconv.Itoa(i)
+		for j := 0; j < 3; j++ {
+			wg.Add(1)
+			go func(order []int) {
+				defer wg.Done()
+				for _, k := range order {
+					s.m.RLock()
+					code, _ := s.register(student, fmt.Sprintf("course-%d", k),
+						studentInfo{Grade: 1, Class: "1"}, auditEntry{})
+					s.m.RUnlock()
+					if code == 0 {
+						atomic.AddInt64(&registered, 1)
+					}
+				}
+			}(rand.Perm(courses))
+		}
+	}
+	wg.Wait()
+
+	if registered != courses*total {
+		t.Errorf("registered %d, want %d", registered, courses*total)
+	}
+	seen := map[string]string{}
+	for _, v := range s.courses {
+		if v.c.Number > v.c.Total || v.c.Number != len(v.students) {
+			t.Errorf("%s: number %d, total %d, students %d",
+				v.c.Name, v.c.Number, v.c.Total, len(v.students))
+		}
+		for student := range v.students {
+			if c, ok := seen[student]; ok {
+				t.Errorf("student %s registered %s and %s", student, c, v.c.Name)
+			}
+			seen[student] = v.c.Name
+			if selected := s.selections(student); len(selected) != 1 || selected[0] != v {
+				t.Errorf("student %s: index does not match %s", student, v.c.Name)
+			}
+		}
+	}
+}
+
+//拆分之前的做法：整个学校一把写锁，不再锁分片和课程
+func registerGlobal(s *school, student, course string, info studentInfo) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e := auditEntry{Action: auditRegister, Student: student, Course: course}
+	v := s.findCourse(course)
+	shard := s.shard(student)
+	if e.Result = s.checkSelection(shard.selected[student], v); e.Result == "" {
+		if s.sharedSeats() {
+			e.Result, _ = dbClient.reserveSeat(s.name, s.table, v.c, student, info, false,
+				s.heldSelection(v, false))
+		} else {
+			e.Result = v.full(info)
+		}
+	}
+	if e.Result == "" {
+		v.add(student, info)
+		shard.index(student, v)
+		s.registerDb(student, v.c)
+		e.Result = "报名成功"
+	}
+	s.audit(e)
+}
+
+//预留名额需要delay，模拟多实例部署时数据库的延迟
+type seatLatencyDb struct {
+	nullDb
+	delay time.Duration
+}
+
+func (self seatLatencyDb) reserveSeat(_, _ string, _ course, _ string, _ studentInfo, _ bool,
+	check func([]string) string) (string, error) {
+
+	time.Sleep(self.delay)
+	return check(nil), nil
+}
+
+//对比整个学校一把写锁和按学生分片、按课程加锁的吞吐量。名额只在内存中计算时
+//持有锁的时间很短，两者相差不大；名额由数据库预留时（shared_seats），一把锁会让
+//所有学生排队等待数据库，分片后不同学生的预留可以同时进行
+func benchmarkRegister(b *testing.B, global, sharedSeats bool) {
+	name := fmt.Sprintf("bench-%t-%t", global, sharedSeats)
+	s := newTestSchool(name, 64, 1<<30)
+	if sharedSeats {
+		saved := config.Schools
+		config.Schools = map[string]SchoolConfig{name: {SharedSeats: true}}
+		defer func() { config.Schools = saved }()
+	}
+
+	var next int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&next, 1)
+			student := strconv.FormatInt(n, 10)
+			course := fmt.Sprintf("course-%d", n%64)
+			info := studentInfo{Grade: 1, Class: "1"}
+			if global {
+				registerGlobal(s, student, course, info)
+			} else {
+				s.m.RLock()
+				s.register(student, course, info, auditEntry{Action: auditRegister,
+					Student: student, Course: course})
+				s.m.RUnlock()
+			}
+		}
+	})
+}
+
+func BenchmarkRegisterGlobalLock(b *testing.B) {
+	benchmarkRegister(b, true, false)
+}
+
+func BenchmarkRegisterShardedLock(b *testing.B) {
+	benchmarkRegister(b, false, false)
+}
+
+func BenchmarkRegisterGlobalLockSharedSeats(b *testing.B) {
+	benchmarkRegister(b, true, true)
+}
+
+func BenchmarkRegisterShardedLockSharedSeats(b *testing.B) {
+	benchmarkRegister(b, false, true)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	rosterActive   = "active"
+	rosterInactive = "inactive" //休学、转学、毕业等，不能登录和报名
+)
+
+const msgNotOnRoster = "不在学生名册中"
+
+//学生名册，启用后只有名册中在读的学生可以登录、查看课程和报名，
+//名册中的年级和班级优先于学生资料和学号
+type rosterEntry struct {
+	Student string `json:"student"`
+	Name    string `json:"name"`
+	Grade   int    `json:"grade"`
+	Class   string `json:"class"`
+	Status  string `json:"status"`
+}
+
+type roster struct {
+	m       sync.RWMutex
+	loaded  bool
+	entries map[string]rosterEntry
+}
+
+func (s *school) rosterEnabled() bool {
+	return s.config().Roster
+}
+
+//从数据库读取名册，加载课程时也会重新读取，其他实例修改的名册在下次加载课程后生效
+func (s *school) reloadRoster() error {
+	entries, err := dbClient.loadRoster(s.name)
+	if err != nil {
+		log.Println("roster:", err)
+		return err
+	}
+	m := make(map[string]rosterEntry, len(entries))
+	for _, v := range entries {
+		m[v.Student] = v
+	}
+	s.roster.m.Lock()
+	s.roster.entries, s.roster.loaded = m, true
+	s.roster.m.Unlock()
+	return nil
+}
+
+//第一次使用时从数据库读取名册
+func (s *school) ensureRoster() error {
+	s.roster.m.RLock()
+	loaded := s.roster.loaded
+	s.roster.m.RUnlock()
+	if loaded {
+		return nil
+	}
+	return s.reloadRoster()
+}
+
+//没有启用名册或学生不在名册中时返回false
+func (s *school) lookupRoster(student string) (rosterEntry, bool) {
+	if !s.rosterEnabled() || s.ensureRoster() != nil {
+		return rosterEntry{}, false
+	}
+	s.roster.m.RLock()
+	e, ok := s.roster.entries[student]
+	s.roster.m.RUnlock()
+	return e, ok
+}
+
+//没有启用名册时所有学生都可以报名，名册无法读取时拒绝所有学生
+func (s *school) onRoster(student string) bool {
+	if !s.rosterEnabled() {
+		return true
+	}
+	e, ok := s.lookupRoster(student)
+	return ok && e.Status == rosterActive
+}
+
+//写入数据库成功后再修改内存中的名册
+func (s *school) saveRoster(entries []rosterEntry) error {
+	err := dbClient.saveRoster(s.name, entries)
+	if err != nil {
+		return err
+	}
+	s.roster.m.Lock()
+	if s.roster.entries == nil {
+		s.roster.entries = map[string]rosterEntry{}
+	}
+	for _, v := range entries {
+		s.roster.entries[v.Student] = v
+	}
+	s.roster.m.Unlock()
+	for _, v := range entries {
+		s.forgetProfile(v.Student)
+	}
+	return nil
+}
+
+func validRosterEntry(e rosterEntry) bool {
+	return e.Student != "" && (e.Status == rosterActive || e.Status == rosterInactive)
+}
+
+//读取csv格式的名册，每行依次为学号、姓名、年级、班级、状态，状态为空时为active。
+//第一行的年级不是数字时作为标题行跳过
+func parseRoster(r io.Reader) ([]rosterEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []rosterEntry{}
+	for i, v := range records {
+		if len(v) < 4 {
+			return nil, fmt.Errorf("第%d行：至少需要学号、姓名、年级和班级", i+1)
+		}
+		grade, err := strconv.Atoi(strings.TrimSpace(v[2]))
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("第%d行：年级必须是数字", i+1)
+		}
+		e := rosterEntry{Student: strings.TrimSpace(v[0]), Name: strings.TrimSpace(v[1]),
+			Grade: grade, Class: strings.TrimSpace(v[3]), Status: rosterActive}
+		if len(v) > 4 && strings.TrimSpace(v[4]) != "" {
+			e.Status = strings.TrimSpace(v[4])
+		}
+		if !validRosterEntry(e) {
+			return nil, fmt.Errorf("第%d行：学号为空或状态不是active、inactive", i+1)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+//导入名册，replace为true时名册中原有、本次没有导入的学生改为inactive
+func (s *school) importRoster(entries []rosterEntry, replace bool) (int, error) {
+	if replace {
+		if err := s.ensureRoster(); err != nil {
+			return 0, err
+		}
+		imported := map[string]bool{}
+		for _, v := range entries {
+			imported[v.Student] = true
+		}
+		s.roster.m.RLock()
+		for k, v := range s.roster.entries {
+			if !imported[k] && v.Status != rosterInactive {
+				v.Status = rosterInactive
+				entries = append(entries, v)
+			}
+		}
+		s.roster.m.RUnlock()
+	}
+	return len(entries), s.saveRoster(entries)
+}
+
+func writeRosterResult(w http.ResponseWriter, errCode int, errMsg string) {
+	b, _ := json.Marshal(map[string]interface{}{"errCode": errCode, "errMsg": errMsg})
+	w.Write(b)
+}
+
+//查看名册，或者上传csv格式的名册（POST，Content-Type为text/csv，请求体为文件内容）。
+//学校和replace在URL参数中，不从请求体读取
+func handleRoster(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	school := getSchool(query.Get("school"))
+	if school == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		if err := school.ensureRoster(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		school.roster.m.RLock()
+		entries := make([]rosterEntry, 0, len(school.roster.entries))
+		for _, v := range school.roster.entries {
+			entries = append(entries, v)
+		}
+		school.roster.m.RUnlock()
+		b, _ := json.Marshal(map[string]interface{}{"enabled": school.rosterEnabled(),
+			"data": entries})
+		w.Write(b)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	entries, err := parseRoster(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		writeRosterResult(w, 1, err.Error())
+		return
+	}
+	//空的名册多半是上传出错，replace时会把所有学生改为inactive
+	if len(entries) == 0 {
+		writeRosterResult(w, 1, "名册中没有学生")
+		return
+	}
+	replace := query.Get("replace") == "1"
+	n, err := school.importRoster(entries, replace)
+	errCode, errMsg := 0, fmt.Sprintf("已导入%d条", n)
+	if err != nil {
+		log.Println("roster:", err)
+		errCode, errMsg = 1, "导入失败"
+	}
+	school.audit(auditEntry{Action: auditRoster, Actor: actorAdmin, Result: errMsg,
+		Detail: fmt.Sprintf("import replace=%t", replace), IP: clientIP(r)})
+	writeRosterResult(w, errCode, errMsg)
+}
+
+//新增或修改名册中的一个学生
+func handleRosterEdit(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil || len(r.Form) != 6 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	school := getSchool(r.FormValue("school"))
+	grade, err := strconv.Atoi(r.FormValue("grade"))
+	e := rosterEntry{Student: r.FormValue("student"), Name: r.FormValue("name"),
+		Grade: grade, Class: r.FormValue("class"), Status: r.FormValue("status")}
+	if err != nil || !validRosterEntry(e) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	errCode, errMsg := 0, "修改成功"
+	if err = school.saveRoster([]rosterEntry{e}); err != nil {
+		log.Println("roster:", err)
+		errCode, errMsg = 1, "修改失败"
+	}
+	school.audit(auditEntry{Action: auditRoster, Actor: actorAdmin, Student: e.Student,
+		Result: errMsg, Detail: fmt.Sprintf("%s %d %s %s", e.Name, e.Grade, e.Class, e.Status),
+		IP: clientIP(r)})
+	w.Write([]byte(fmt.Sprintf(`{"errCode":%d,"errMsg":"%s"}`, errCode, errMsg)))
+}
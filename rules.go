@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+)
+
+//选课规则：学生在同一报名类别中最多能报Max门Group分组的课程，
+//Group为空表示不区分分组。例如"1门艺术+1门体育"可以配置为：
+//  - {group: 艺术, max: 1}
+//  - {group: 体育, max: 1}
+//  - {max: 2}
+type SelectionRule struct {
+	Group string `yaml:"group"`
+	Max   int    `yaml:"max"`
+}
+
+//没有配置规则时保持每个学生只能报一门课
+var defaultRules = []SelectionRule{{Max: 1}}
+
+func (self SelectionRule) match(c *courseObj) bool {
+	return self.Group == "" || self.Group == c.c.Group
+}
+
+func (self SelectionRule) errMsg() string {
+	if self.Group == "" {
+		if self.Max <= 1 {
+			return "禁止报多门课"
+		}
+		return fmt.Sprintf("最多只能报%d门课", self.Max)
+	}
+	return fmt.Sprintf("%s类课程最多只能报%d门", self.Group, self.Max)
+}
+
+func (s *school) config() SchoolConfig {
+	return config.Schools[s.name]
+}
+
+func (s *school) selectionRules() []SelectionRule {
+	rules := s.config().Rules[s.courseTag]
+	if len(rules) == 0 {
+		return defaultRules
+	}
+	return rules
+}
+
+//返回学生已报名的课程，调用者需持有s.m写锁，或者持有s.m读锁和学生所在分片的锁
+func (s *school) selections(student string) []*courseObj {
+	selected := s.shard(student).selected[student]
+	return append(make([]*courseObj, 0, len(selected)), selected...)
+}
+
+//检查学生在已报课程selected之外再报target是否违反选课规则，
+//返回空字符串表示允许报名，否则返回错误信息
+func checkRules(rules []SelectionRule, selected []*courseObj, target *courseObj) string {
+	for _, rule := range rules {
+		if !rule.match(target) {
+			continue
+		}
+		n := 1
+		for _, v := range selected {
+			if v != target && rule.match(v) {
+				n++
+			}
+		}
+		if n > rule.Max {
+			return rule.errMsg()
+		}
+	}
+	return ""
+}
+
+//检查学生在已选课程selected之外再报target是否违反选课规则或上课时间冲突，
+//返回空字符串表示允许报名，只读取课程不变的字段，调用者需持有s.m
+func (s *school) checkSelection(selected []*courseObj, target *courseObj) string {
+	if msg := checkRules(s.selectionRules(), selected, target); msg != "" {
+		return msg
+	}
+	if c := scheduleConflict(selected, target); c != nil {
+		return fmt.Sprintf("与%s上课时间冲突", c.c.Name)
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//课程的一个上课时间段，例如：每周二第7-8节，2019-09-01至2020-01-15
+type timeSlot struct {
+	Weekday int    `json:"weekday"` //星期几，1-7
+	From    int    `json:"from"`    //开始节次
+	To      int    `json:"to"`      //结束节次
+	Start   string `json:"start"`   //开始日期，格式2006-01-02，为空表示不限
+	End     string `json:"end"`     //结束日期，格式2006-01-02，为空表示不限
+}
+
+//日期格式固定为2006-01-02，可以直接按字符串比较
+func dateOverlap(a, b timeSlot) bool {
+	if a.End != "" && b.Start != "" && a.End < b.Start {
+		return false
+	}
+	if b.End != "" && a.Start != "" && b.End < a.Start {
+		return false
+	}
+	return true
+}
+
+func (self timeSlot) conflict(other timeSlot) bool {
+	return self.Weekday == other.Weekday &&
+		self.From <= other.To && other.From <= self.To &&
+		dateOverlap(self, other)
+}
+
+//返回selected中与target上课时间冲突的课程，没有冲突返回nil
+func scheduleConflict(selected []*courseObj, target *courseObj) *courseObj {
+	for _, v := range selected {
+		if v == target {
+			continue
+		}
+		for _, a := range v.c.Schedule {
+			for _, b := range target.c.Schedule {
+				if a.conflict(b) {
+					return v
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//解析sql数据库中的上课时间，多个时间段用分号分隔，例如：
+//
+//	2:7-8;4:3@2019-09-01~2020-01-15
+//
+//表示周二第7-8节，以及2019-09-01至2020-01-15期间的周四第3节
+func parseSchedule(schedule string) ([]timeSlot, error) {
+	slots := []timeSlot{}
+	for _, v := range strings.Split(schedule, ";") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		slot := timeSlot{}
+		if i := strings.Index(v, "@"); i >= 0 {
+			dates := strings.SplitN(v[i+1:], "~", 2)
+			slot.Start = strings.TrimSpace(dates[0])
+			if len(dates) == 2 {
+				slot.End = strings.TrimSpace(dates[1])
+			}
+			v = v[:i]
+		}
+
+		s := strings.SplitN(v, ":", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid schedule: %s", schedule)
+		}
+		weekday, err := strconv.Atoi(strings.TrimSpace(s[0]))
+		if err != nil || weekday < 1 || weekday > 7 {
+			return nil, fmt.Errorf("invalid weekday: %s", schedule)
+		}
+		slot.Weekday = weekday
+
+		periods := strings.SplitN(s[1], "-", 2)
+		slot.From, err = strconv.Atoi(strings.TrimSpace(periods[0]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid period: %s", schedule)
+		}
+		slot.To = slot.From
+		if len(periods) == 2 {
+			slot.To, err = strconv.Atoi(strings.TrimSpace(periods[1]))
+			if err != nil || slot.To < slot.From {
+				return nil, fmt.Errorf("invalid period: %s", schedule)
+			}
+		}
+		slots = append(slots, slot)
+	}
+	return slots, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+//多实例部署：多个xsj实例同时为一个学校服务时，名额由数据库原子地预留，
+//每个实例的内存中只保存由本实例处理的学生名单，报名人数定期从数据库同步。
+//学生占用的课程也记录在数据库中，预留名额时按这些记录检查重复报名和选课规则，
+//同一学生的请求被转发到不同实例时也不会重复报名。只用于先到先得模式，
+//每次报名的课程表在报名开始前人数应为0，seat_holder中也没有该课程表的记录
+type seatCount struct {
+	Number  int
+	Grades  map[int]int
+	Classes map[string]int
+}
+
+func newSeatCount() seatCount {
+	return seatCount{Grades: map[int]int{}, Classes: map[string]int{}}
+}
+
+//调用者需持有s.m
+func (s *school) sharedSeats() bool {
+	return s.config().SharedSeats && (s.mode == "" || s.mode == modeFcfs)
+}
+
+//占用一个名额并把学生加入课程名单，返回报名后的课程信息和错误信息，
+//错误信息为空表示成功。force为true时不检查名额，调用者需持有s.m和学生所在分片的锁。
+//e不为nil时在决定结果时追加审计记录，成功时使用e中已有的结果
+func (s *school) reserve(student string, v *courseObj, info studentInfo, force bool,
+	e *auditEntry) (c course, msg string) {
+
+	if s.sharedSeats() {
+		return s.reserveShared(student, v, info, force, e)
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	defer func() { s.auditDecision(e, msg) }()
+	if !force {
+		if full := v.full(info); full != "" {
+			return v.c, full
+		}
+	}
+	if _, ok := v.students[student]; ok {
+		return v.c, "重复报名"
+	}
+	v.add(student, info)
+	return v.c, ""
+}
+
+//数据库预留名额期间不持有课程的锁，同一课程的其它学生可以同时报名，
+//名额由数据库决定，审计记录只保证与同一学生的其它操作顺序一致
+func (s *school) reserveShared(student string, v *courseObj, info studentInfo, force bool,
+	e *auditEntry) (course, string) {
+
+	v.m.Lock()
+	_, ok := v.students[student]
+	c := v.c
+	v.m.Unlock()
+	if ok {
+		s.auditDecision(e, "重复报名")
+		return c, "重复报名"
+	}
+
+	msg, err := dbClient.reserveSeat(s.name, s.table, c, student, info, force,
+		s.heldSelection(v, force))
+	if err != nil {
+		log.Println("reserve seat:", err)
+		msg = "报名失败"
+	}
+	if msg != "" {
+		s.auditDecision(e, msg)
+		return c, msg
+	}
+
+	v.m.Lock()
+	v.add(student, info)
+	c = v.c
+	s.auditDecision(e, "")
+	v.m.Unlock()
+	return c, ""
+}
+
+//返回在数据库中检查学生已占用课程的函数，包括其它实例处理的报名，
+//force为true时只检查重复报名，调用者需持有s.m
+func (s *school) heldSelection(target *courseObj, force bool) func([]string) string {
+	return func(held []string) string {
+		selected := make([]*courseObj, 0, len(held))
+		for _, name := range held {
+			if name == target.c.Name {
+				return "重复报名"
+			}
+			if v := s.findCourse(name); v != nil {
+				selected = append(selected, v)
+			}
+		}
+		if force {
+			return ""
+		}
+		return s.checkSelection(selected, target)
+	}
+}
+
+//数据库中名额已满时返回原因，读取人数时已有学生取消的按总人数已满处理
+func seatsFull(c course, n seatCount, info studentInfo) string {
+	v := NewCourseObj(c)
+	v.c.Number, v.gradeCount, v.classCount = n.Number, n.Grades, n.Classes
+	if msg := v.full(info); msg != "" {
+		return msg
+	}
+	return "已报满"
+}
+
+//释放名额并把学生移出课程名单，学生没有报名该课程或数据库写入失败时返回false，
+//调用者需持有s.m和学生所在分片的锁，e与reserve相同，失败时结果为取消失败
+func (s *school) release(student string, v *courseObj, e *auditEntry) (ok bool) {
+	if !s.sharedSeats() {
+		v.m.Lock()
+		defer v.m.Unlock()
+		defer func() { s.auditRelease(e, ok) }()
+		return v.remove(student)
+	}
+
+	v.m.Lock()
+	info, ok := v.students[student]
+	c := v.c
+	v.m.Unlock()
+	if !ok {
+		s.auditRelease(e, false)
+		return false
+	}
+	if err := dbClient.releaseSeat(s.name, s.table, c, student, info); err != nil {
+		log.Println("release seat:", err)
+		s.auditRelease(e, false)
+		return false
+	}
+
+	v.m.Lock()
+	v.remove(student)
+	s.auditRelease(e, true)
+	v.m.Unlock()
+	return true
+}
+
+//在决定名额的锁内追加审计记录，msg为空表示成功，e为nil时由调用者记录
+func (s *school) auditDecision(e *auditEntry, msg string) {
+	if e == nil {
+		return
+	}
+	if msg != "" {
+		e.Result = msg
+	}
+	s.audit(*e)
+}
+
+func (s *school) auditRelease(e *auditEntry, ok bool) {
+	if ok {
+		s.auditDecision(e, "")
+	} else {
+		s.auditDecision(e, "取消失败")
+	}
+}
+
+//用数据库中的人数替换内存中的人数，包括其它实例报名的学生
+func (s *school) syncSeats() {
+	s.m.RLock()
+	table := s.table
+	s.m.RUnlock()
+
+	counts, err := dbClient.loadSeats(s.name, table)
+	if err != nil {
+		log.Println("sync seats:", err)
+		return
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.table != table {
+		return
+	}
+	for _, v := range s.courses {
+		n, ok := counts[v.c.Name]
+		if !ok {
+			continue
+		}
+		v.m.Lock()
+		v.c.Number = n.Number
+		v.gradeCount = n.Grades
+		v.classCount = n.Classes
+		v.m.Unlock()
+	}
+}
+
+//报名期间定期同步报名人数，重新加载课程后退出
+type SeatSyncHandler struct {
+	s       *school
+	name    string //课程类别名称
+	seconds int64
+	syncing int32
+}
+
+func (self *SeatSyncHandler) handle() int {
+	self.s.m.RLock()
+	valid := self.s.courseTag == self.name
+	self.s.m.RUnlock()
+	if !valid {
+		return Quit()
+	}
+
+	interval := int64(self.s.config().SeatSync)
+	if interval <= 0 {
+		interval = 1
+	}
+	self.seconds += 1
+	if self.seconds%interval != 0 {
+		return Continue()
+	}
+
+	//数据库较慢时跳过本次同步，不阻塞其它定时器
+	if atomic.CompareAndSwapInt32(&self.syncing, 0, 1) {
+		timerTasks.Add(1)
+		go func() {
+			defer timerTasks.Done()
+			self.s.syncSeats()
+			atomic.StoreInt32(&self.syncing, 0)
+		}()
+	}
+	return Continue()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var server *http.Server
+var shutdownOnce sync.Once
+
+//控制台在退出时不再执行新的命令
+var cmdStopped int32
+
+//等待dbChannels中的数据写入数据库，超时后把剩下的数据转入死信队列，
+//返回写入、转入死信队列和仍未处理的条数
+func drainDb(timeout time.Duration) (int64, int64, int64) {
+	handled, failed := atomic.LoadInt64(&dbHandled), atomic.LoadInt64(&dbFailed)
+	wait := func() {
+		deadline := time.Now().Add(timeout)
+		for atomic.LoadInt64(&dbPending) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wait()
+	//写入协程处理完正在写入的一批后，队列中剩下的数据直接转入死信队列
+	atomic.StoreInt32(&dbParking, 1)
+	wait()
+
+	parked := atomic.LoadInt64(&dbFailed) - failed
+	return atomic.LoadInt64(&dbHandled) - handled - parked, parked, atomic.LoadInt64(&dbPending)
+}
+
+//停止接受新的请求和控制台命令，等待处理中的请求和定时器结束，再把dbChannels中的数据写入数据库
+func shutdown() {
+	shutdownOnce.Do(func() {
+		timeout := time.Duration(config.ShutdownTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+
+		ColorRed("\n正在停止服务...")
+		atomic.StoreInt32(&cmdStopped, 1)
+		closeRedirectServer()
+		if server != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := server.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		stopTimers()
+
+		fmt.Printf("正在写入数据库，剩余%d条...\n", atomic.LoadInt64(&dbPending))
+		flushed, parked, lost := drainDb(timeout)
+		if parked > 0 || lost > 0 {
+			ColorRed(fmt.Sprintf("已写入%d条，%d条转入死信队列，%d条未能写入",
+				flushed, parked, lost))
+		} else {
+			ColorGreen(fmt.Sprintf("已写入%d条，全部数据已写入数据库", flushed))
+		}
+		drainNotify(timeout)
+	})
+}
+
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		shutdown()
+		os.Exit(0)
+	}()
+}
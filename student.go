@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type profile struct {
+	Name   string `json:"name"`
+	Avatar string `json:"avatar"`
+	Grade  int    `json:"grade"` //年级，0表示未知，按学号推算
+	Class  string `json:"class"` //行政班，为空时按学号推算
+	Email  string `json:"-"`     //以下为接收通知的联系方式，不返回给客户端
+	Phone  string `json:"-"`
+	OpenId string `json:"-"` //微信小程序的openid
+}
+
+//学号格式，Pattern为正则表达式，命名分组year为入学年份（2位或4位），
+//也可以用命名分组grade直接给出年级，命名分组class为班级
+type StudentIdConfig struct {
+	Pattern string `yaml:"pattern"`
+}
+
+//学年设置，Level可以取primary、junior、senior，分别对应小学1-6年级、
+//初中7-9年级、高中10-12年级，FirstGrade和Grades不为0时覆盖Level的设置
+type CalendarConfig struct {
+	Level      string `yaml:"level"`
+	FirstGrade int    `yaml:"first_grade"` //最低年级
+	Grades     int    `yaml:"grades"`      //年级数
+	StartMonth int    `yaml:"start_month"` //新学年开始的月份，默认9月
+	StartDay   int    `yaml:"start_day"`   //新学年开始的日期，默认1日
+}
+
+var errBadStudentId = errors.New("bad student id")
+
+var defaultStudentId = regexp.MustCompile(`^(?P<year>\d{2})`)
+
+var levels = map[string][2]int{ //最低年级，年级数
+	"primary": {1, 6},
+	"junior":  {7, 3},
+	"senior":  {10, 3},
+}
+
+func (self CalendarConfig) withDefaults() CalendarConfig {
+	level, ok := levels[self.Level]
+	if !ok {
+		level = levels["primary"]
+	}
+	if self.FirstGrade == 0 {
+		self.FirstGrade = level[0]
+	}
+	if self.Grades == 0 {
+		self.Grades = level[1]
+	}
+	if self.StartMonth == 0 {
+		self.StartMonth = 9
+	}
+	if self.StartDay == 0 {
+		self.StartDay = 1
+	}
+	return self
+}
+
+//根据入学年份计算now所在学年的年级，不在本校年级范围内返回0
+func (self CalendarConfig) grade(entryYear int, now time.Time) int {
+	c := self.withDefaults()
+	year := now.Year()
+	start := time.Date(year, time.Month(c.StartMonth), c.StartDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		year--
+	}
+
+	grade := c.FirstGrade + year - entryYear
+	if grade < c.FirstGrade || grade >= c.FirstGrade+c.Grades {
+		return 0
+	}
+	return grade
+}
+
+//配置中各学校的学号格式，启动时编译，之后只读
+var patterns = map[string]*regexp.Regexp{}
+
+//编译并检查各学校配置的学号格式，格式错误时不能启动
+func compileStudentIds(schools map[string]SchoolConfig) error {
+	for name, school := range schools {
+		pattern := school.StudentId.Pattern
+		if pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("schools.%s.student_id.pattern: %v", name, err)
+		}
+		if re.SubexpIndex("year") < 0 && re.SubexpIndex("grade") < 0 {
+			return fmt.Errorf("schools.%s.student_id.pattern: missing named group year or grade", name)
+		}
+		patterns[pattern] = re
+	}
+	return nil
+}
+
+func (s *school) studentIdPattern() *regexp.Regexp {
+	if re, ok := patterns[s.config().StudentId.Pattern]; ok {
+		return re
+	}
+	return defaultStudentId
+}
+
+//从学号中解析出命名分组，学号不符合格式时返回errBadStudentId
+func (s *school) parseStudentId(student string) (map[string]string, error) {
+	re := s.studentIdPattern()
+	match := re.FindStringSubmatch(student)
+	if match == nil {
+		return nil, errBadStudentId
+	}
+
+	fields := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			fields[name] = match[i]
+		}
+	}
+	return fields, nil
+}
+
+func (s *school) infoFromId(student string) (studentInfo, error) {
+	fields, err := s.parseStudentId(student)
+	if err != nil {
+		return studentInfo{}, err
+	}
+
+	info := studentInfo{Class: fields["class"]}
+	if v, ok := fields["grade"]; ok {
+		info.Grade, err = strconv.Atoi(v)
+		if err != nil {
+			return studentInfo{}, errBadStudentId
+		}
+		return info, nil
+	}
+
+	year, err := strconv.Atoi(fields["year"])
+	if err != nil {
+		return studentInfo{}, errBadStudentId
+	}
+	if year < 100 {
+		year += 2000
+	}
+	info.Grade = s.config().Calendar.grade(year, time.Now())
+	return info, nil
+}
+
+const (
+	profileTtl        = 10 * time.Minute
+	missingProfileTtl = 30 * time.Second //没有资料的学生可能随后补录，较快重新查询
+	maxProfiles       = 50000            //学号由客户端提交，限制缓存条数
+)
+
+type profileEntry struct {
+	p       *profile //nil表示没有资料
+	expires time.Time
+}
+
+//学生资料在报名期间几乎不变，缓存起来避免每次查询课程都访问数据库
+func (s *school) cachedProfile(student string) (*profile, bool) {
+	s.mutexProfiles.Lock()
+	defer s.mutexProfiles.Unlock()
+	e, ok := s.profiles[student]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(s.profiles, student)
+		return nil, false
+	}
+	return e.p, true
+}
+
+func (s *school) cacheProfile(student string, p *profile) {
+	now := time.Now()
+	ttl := profileTtl
+	if p == nil {
+		ttl = missingProfileTtl
+	}
+	s.mutexProfiles.Lock()
+	if len(s.profiles) >= maxProfiles {
+		s.evictProfiles(now)
+	}
+	s.profiles[student] = profileEntry{p, now.Add(ttl)}
+	s.mutexProfiles.Unlock()
+}
+
+//先删除过期的缓存，仍然超过上限时任意删除一半，调用者需持有s.mutexProfiles
+func (s *school) evictProfiles(now time.Time) {
+	for k, v := range s.profiles {
+		if now.After(v.expires) {
+			delete(s.profiles, k)
+		}
+	}
+	for k := range s.profiles {
+		if len(s.profiles) < maxProfiles/2 {
+			break
+		}
+		delete(s.profiles, k)
+	}
+}
+
+//加载新的课程时清空缓存，报名期间修改的资料在下一次报名时一定生效
+func (s *school) resetProfiles() {
+	s.mutexProfiles.Lock()
+	s.profiles = map[string]profileEntry{}
+	s.parents = map[string]parentEntry{}
+	s.mutexProfiles.Unlock()
+}
+
+//资料修改后删除缓存，下次使用时重新从数据库读取
+func (s *school) forgetProfile(student string) {
+	s.mutexProfiles.Lock()
+	delete(s.profiles, student)
+	s.mutexProfiles.Unlock()
+}
+
+func (s *school) getStudentProfile(student string) (profile, error) {
+	p, err := dbClient.getStudentProfile(s.name, student)
+	if err == nil {
+		s.cacheProfile(student, &p)
+	} else if err == errNotFound {
+		s.cacheProfile(student, nil)
+	}
+	return p, err
+}
+
+//优先使用学生名册中的年级和班级，其次为学生资料，都没有的部分按学号推算，
+//已知年级时学号不符合格式也不影响报名
+func (s *school) studentInfo(student string) (studentInfo, error) {
+	info := studentInfo{}
+	if e, ok := s.lookupRoster(student); ok {
+		info = studentInfo{e.Grade, e.Class}
+	}
+	if info.Grade != 0 && info.Class != "" {
+		return info, nil
+	}
+	p, ok := s.cachedProfile(student)
+	if !ok {
+		if profile, err := s.getStudentProfile(student); err == nil {
+			p = &profile
+		}
+	}
+	if p != nil && info.Grade == 0 {
+		info.Grade = p.Grade
+	}
+	if p != nil && info.Class == "" {
+		info.Class = p.Class
+	}
+	if info.Grade != 0 && info.Class != "" {
+		return info, nil
+	}
+
+	derived, err := s.infoFromId(student)
+	if err != nil {
+		if info.Grade != 0 {
+			return info, nil
+		}
+		return derived, err
+	}
+	if info.Grade == 0 {
+		info.Grade = derived.Grade
+	}
+	if info.Class == "" {
+		info.Class = derived.Class
+	}
+	return info, nil
+}
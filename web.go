@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//学生使用的网页，编译时打包进程序，只调用已有的报名接口
+//
+//go:embed web
+var webFiles embed.FS
+
+func webHandler() http.Handler {
+	root, _ := fs.Sub(webFiles, "web")
+	files := http.FileServer(http.FS(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//没有注册的接口都会落到这里，不存在的文件交给FileServer返回404
+		w.Header().Set("Cache-Control", "no-cache")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+'use strict';
+
+const $ = (id) => document.getElementById(id);
+const actions = {
+  'register': '报名',
+  'cancel': '取消',
+  'preference': '填报志愿',
+  'course-load': '加载课程',
+  'course-edit': '修改课程',
+  'timer-set': '设置时间',
+  'timer-cancel': '取消时间',
+  'lottery-draw': '抽签',
+  'allocate': '志愿分配',
+  'admin-enroll': '管理员报名',
+  'admin-drop': '管理员退课',
+  'avatar-upload': '上传头像',
+  'roster-update': '修改名册',
+};
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (className) e.className = className;
+  return e;
+}
+
+function clock(seconds) {
+  const h = Math.floor(seconds / 3600), m = Math.floor(seconds / 60) % 60, s = seconds % 60;
+  return [h, m, s].map((v) => String(v).padStart(2, '0')).join(':');
+}
+
+async function refresh() {
+  const response = await fetch('/admin/dashboard', {
+    headers: { 'X-Admin-Token': sessionStorage.getItem('adminToken') || '' },
+  });
+  if (response.status === 401) {
+    sessionStorage.removeItem('adminToken');
+    location.reload();
+    return;
+  }
+  const data = await response.json();
+  render(data);
+  $('updated').textContent = '更新于 ' + new Date().toLocaleTimeString();
+}
+
+function render(data) {
+  $('database').textContent = data.database.ok ? '正常' : data.database.detail;
+  $('database').className = data.database.ok ? '' : 'bad';
+  $('pending').textContent = data.pending;
+  $('handled').textContent = data.handled;
+  $('retries').textContent = data.retries;
+  $('failed').textContent = data.failed;
+  $('failed').className = data.failed > 0 ? 'bad' : '';
+  $('channels').textContent = '各写入协程队列：' + data.channels.join(' / ');
+
+  const schools = $('schools');
+  schools.replaceChildren();
+  for (const s of data.schools) {
+    const card = el('div', undefined, 'card');
+    const head = el('div', undefined, 'school-head');
+    head.append(el('h2', s.name), el('span', s.courseTag || '未加载课程'),
+      el('span', s.mode || 'fcfs', 'badge'),
+      el('span', s.started ? (s.closed ? '已截止' : '报名中') : '未开始', s.started ? 'badge on' : 'badge'));
+    card.append(head);
+
+    const timers = el('div', undefined, 'timers');
+    for (const t of s.timers) {
+      timers.append(el('div', `${t.name} ${t.kind === 'close' ? '截止' : '开始'}倒计时 ${clock(t.seconds)}`));
+    }
+    card.append(timers);
+
+    for (const c of s.courses) {
+      const row = el('div', undefined, 'course');
+      const bar = el('div', undefined, 'bar');
+      const fill = el('div', undefined, c.number >= c.total ? 'full' : '');
+      fill.style.width = (c.total > 0 ? Math.min(100, c.number * 100 / c.total) : 0) + '%';
+      bar.append(fill);
+      row.append(el('span', c.name), bar, el('span', `${c.number}/${c.total}`, 'count'));
+      card.append(row);
+    }
+    schools.append(card);
+  }
+
+  const tbody = $('events').querySelector('tbody');
+  tbody.replaceChildren();
+  for (const e of data.events) {
+    const tr = el('tr');
+    tr.append(el('td', new Date(e.timestamp).toLocaleTimeString()), el('td', e.school),
+      el('td', actions[e.action] || e.action), el('td', e.student), el('td', e.course),
+      el('td', e.result || e.detail));
+    tbody.append(tr);
+  }
+}
+
+function start() {
+  $('login').hidden = true;
+  $('dashboard').hidden = false;
+  refresh();
+  setInterval(() => refresh().catch(() => { $('updated').textContent = '连接中断'; }), 1000);
+}
+
+$('login-form').addEventListener('submit', (event) => {
+  event.preventDefault();
+  sessionStorage.setItem('adminToken', $('token').value);
+  start();
+});
+if (sessionStorage.getItem('adminToken')) start();
@@ -0,0 +1,317 @@
+'use strict';
+
+const state = {
+  school: localStorage.getItem('school') || new URLSearchParams(location.search).get('school') || '',
+  student: localStorage.getItem('student') || '',
+  parent: localStorage.getItem('parent') || '',
+  children: [],
+  started: false,
+  selected: new Set(),
+  deadline: 0,
+};
+
+const $ = (id) => document.getElementById(id);
+const weekdays = ['', '周一', '周二', '周三', '周四', '周五', '周六', '周日'];
+
+async function post(path, params) {
+  const headers = { 'Content-Type': 'application/x-www-form-urlencoded' };
+  //家长代为报名时需要家长的令牌
+  const token = sessionStorage.getItem('token');
+  if (token) headers.Authorization = 'Bearer ' + token;
+  const response = await fetch(path, {
+    method: 'POST',
+    headers: headers,
+    body: new URLSearchParams(params),
+  });
+  if (response.status === 429) {
+    throw new Error('请求太频繁，请稍后再试');
+  }
+  if (!response.ok) {
+    throw new Error('请求失败：' + response.status);
+  }
+  return response.json();
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (className) e.className = className;
+  return e;
+}
+
+function showMessage(text, ok) {
+  const m = $('message');
+  m.textContent = text;
+  m.className = ok ? 'ok' : '';
+  m.hidden = false;
+}
+
+function schedule(slots) {
+  return (slots || []).map((s) => `${weekdays[s.weekday] || ''} ${s.from}-${s.to}节`).join('，');
+}
+
+function loginError(text, notice) {
+  $('login-error').textContent = text;
+  $('login-error').className = notice ? 'error notice' : 'error';
+  $('login-error').hidden = !text;
+}
+
+function role() {
+  return document.querySelector('input[name="role"]:checked').value;
+}
+
+function switchRole() {
+  const parent = role() === 'parent';
+  $('student-field').hidden = parent;
+  $('parent-field').hidden = !parent;
+  $('student').required = !parent;
+  $('parent').required = parent;
+  showCode(false);
+  loginError('');
+}
+
+function showCode(show) {
+  $('code-field').hidden = !show;
+  $('code').required = show;
+  if (!show) $('code').value = '';
+}
+
+async function login(event) {
+  event.preventDefault();
+  loginError('');
+  sessionStorage.removeItem('token');
+  state.school = $('school').value.trim();
+  if (role() === 'parent') {
+    parentLogin();
+    return;
+  }
+  state.student = $('student').value.trim();
+  let result;
+  try {
+    result = await post('/login', { school: state.school, student: state.student });
+  } catch (e) {
+    loginError(e.message.endsWith('400') ? '学号格式错误' : e.message);
+    return;
+  }
+  if (result.errCode !== 0) {
+    loginError('登录失败，请检查学校和学号');
+    return;
+  }
+  localStorage.setItem('school', state.school);
+  localStorage.setItem('student', state.student);
+  if (result.token) sessionStorage.setItem('token', result.token);
+  $('name').textContent = result.name || state.student;
+  showAvatar(result.avatar);
+  enter();
+}
+
+//家长先获取短信验证码，输入验证码后才返回令牌和关联的学生
+async function parentLogin() {
+  const parent = $('parent').value.trim();
+  if (parent !== state.parent) showCode(false);
+  state.parent = parent;
+  const params = { school: state.school, parent: state.parent };
+  const verifying = !$('code-field').hidden;
+  if (verifying) params.code = $('code').value.trim();
+  let result;
+  try {
+    result = await post('/login', params);
+  } catch (e) {
+    loginError(e.message);
+    return;
+  }
+  if (result.errCode !== 0) {
+    loginError(result.errMsg || '登录失败，请检查学校和家长编号');
+    return;
+  }
+  if (!verifying) {
+    showCode(true);
+    loginError((result.errMsg || '验证码已发送') + '，请输入手机收到的验证码', true);
+    $('code').focus();
+    return;
+  }
+  if (!(result.children || []).length) {
+    loginError('没有关联的学生，请联系学校');
+    return;
+  }
+  localStorage.setItem('school', state.school);
+  localStorage.setItem('parent', state.parent);
+  sessionStorage.setItem('token', result.token);
+  $('name').textContent = result.name || state.parent;
+  showChildren(result.children);
+  enter();
+}
+
+function showAvatar(avatar) {
+  $('avatar').hidden = !avatar;
+  if (avatar) $('avatar').src = '/avatar/' + avatar;
+}
+
+//家长登录后选择为哪个孩子查看和报名
+function showChildren(children) {
+  state.children = children;
+  const select = $('child');
+  select.replaceChildren();
+  for (const c of children) {
+    const option = el('option', c.name || c.student);
+    option.value = c.student;
+    select.append(option);
+  }
+  state.student = children[0].student;
+  showAvatar(children[0].avatar);
+  $('children').hidden = false;
+}
+
+function switchChild() {
+  state.student = $('child').value;
+  const c = state.children.find((c) => c.student === state.student);
+  showAvatar(c && c.avatar);
+  $('message').hidden = true;
+  refreshAll();
+}
+
+function logout() {
+  localStorage.removeItem('student');
+  localStorage.removeItem('parent');
+  sessionStorage.removeItem('token');
+  location.reload();
+}
+
+function enter() {
+  $('login').hidden = true;
+  $('session').hidden = false;
+  $('user').hidden = false;
+  refreshStatus();
+  refreshAll();
+  setInterval(tick, 1000);
+}
+
+async function refreshStatus() {
+  const status = await post('/status', { school: state.school });
+  $('course-tag').textContent = status.courseTag || '';
+  const started = status.status === 'started';
+  if (started !== state.started) {
+    state.started = started;
+    refreshAll();
+  }
+  if (started) {
+    $('countdown').textContent = '报名进行中';
+    return;
+  }
+
+  //报名开始时间由服务器的定时器决定，按剩余秒数在本地倒计时
+  const timers = await post('/get-timer', { school: state.school });
+  const timer = (timers.data || []).find((t) => t.name === status.courseTag) || (timers.data || [])[0];
+  if (timer) {
+    const [h, m, s] = timer.time.split(':').map(Number);
+    state.deadline = Date.now() + ((h * 60 + m) * 60 + s) * 1000;
+  } else {
+    state.deadline = 0;
+    $('countdown').textContent = '报名尚未开始';
+  }
+}
+
+let polls = 0;
+function tick() {
+  polls++;
+  if (state.started) {
+    //报名期间定期刷新剩余名额
+    if (polls % 5 === 0) refreshCourses();
+    return;
+  }
+  if (state.deadline) {
+    const left = Math.max(0, Math.round((state.deadline - Date.now()) / 1000));
+    const h = Math.floor(left / 3600), m = Math.floor(left / 60) % 60, s = left % 60;
+    $('countdown').textContent = '距离报名开始 ' +
+      [h, m, s].map((v) => String(v).padStart(2, '0')).join(':');
+    if (left === 0) refreshStatus();
+  } else if (polls % 10 === 0) {
+    refreshStatus();
+  }
+}
+
+function refreshAll() {
+  refreshSelected().then(refreshCourses);
+  refreshHistory();
+}
+
+async function refreshCourses() {
+  let result;
+  try {
+    result = await post('/course', { school: state.school, student: state.student });
+  } catch (e) {
+    showMessage(e.message.endsWith('400') ? '学号格式错误' : e.message);
+    return;
+  }
+  const tbody = $('courses').querySelector('tbody');
+  tbody.replaceChildren();
+  for (const c of result.data || []) {
+    const tr = el('tr');
+    tr.append(el('td', c.name), el('td', c.teacher), el('td', schedule(c.schedule)),
+      el('td', `${c.remaining}/${c.total}`, 'remaining'));
+    const td = el('td');
+    if (state.selected.has(c.name)) {
+      td.append(actionButton('取消', 'cancel', '/cancel', c.name));
+    } else {
+      const b = actionButton('报名', '', '/register', c.name);
+      b.disabled = !state.started || c.remaining <= 0;
+      td.append(b);
+    }
+    tr.append(td);
+    tbody.append(tr);
+  }
+}
+
+function actionButton(text, className, path, course) {
+  const b = el('button', text, className);
+  b.addEventListener('click', async () => {
+    b.disabled = true;
+    try {
+      const result = await post(path, { school: state.school, student: state.student, course: course });
+      showMessage(`${course}：${result.errMsg}`, result.errCode === 0);
+    } catch (e) {
+      showMessage(e.message);
+    }
+    refreshAll();
+  });
+  return b;
+}
+
+async function refreshSelected() {
+  const info = await post('/register-info', { school: state.school, student: state.student });
+  state.selected = new Set((info.courses || []).map((c) => c.name));
+  const list = $('selected');
+  list.replaceChildren();
+  for (const c of info.courses || []) {
+    const li = el('li');
+    li.append(el('span', `${c.name}（${c.teacher}）`), el('span', schedule(c.schedule)));
+    list.append(li);
+  }
+  for (const name of info.applications || []) {
+    list.append(el('li', `${name}（已提交抽签申请）`));
+  }
+  if (!list.children.length) list.append(el('li', '还没有报名', 'empty'));
+}
+
+async function refreshHistory() {
+  const history = await post('/register-history', { school: state.school, student: state.student });
+  const list = $('history');
+  list.replaceChildren();
+  for (const r of history.data || []) {
+    const li = el('li');
+    li.append(el('span', `${r.course}（${r.teacher}）`),
+      el('span', new Date(r.timestamp * 1000).toLocaleString()));
+    list.append(li);
+  }
+  if (!list.children.length) list.append(el('li', '没有报名记录', 'empty'));
+}
+
+$('login-form').addEventListener('submit', login);
+$('logout').addEventListener('click', logout);
+$('child').addEventListener('change', switchChild);
+for (const r of document.querySelectorAll('input[name="role"]')) {
+  r.addEventListener('change', switchRole);
+}
+$('school').value = state.school;
+$('student').value = state.student;
+$('parent').value = state.parent;
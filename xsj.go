@@ -11,17 +11,55 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync/atomic"
 	"time"
 	"ziphttp"
 )
 
 type Config struct {
-	Cert   string `yaml:"cert_path"`
-	Key    string `yaml:"key_path"`
-	Avatar string `yaml:"avatar_path"`
+	Cert       string                  `yaml:"cert_path"`
+	Key        string                  `yaml:"key_path"`
+	Avatar     string                  `yaml:"avatar_path"`
+	AdminToken string                  `yaml:"admin_token"` //管理接口的访问令牌
+	Secret     string                  `yaml:"secret"`      //签发登录令牌的密钥
+	TokenTtl   int                     `yaml:"token_ttl"`   //登录令牌的有效小时数，默认12
+	RateLimit  RateLimitConfig         `yaml:"rate_limit"`
+	Schools    map[string]SchoolConfig `yaml:"schools"`
+
+	Server          ServerConfig      `yaml:"server"`
+	Ready           ReadyConfig       `yaml:"ready"`
+	DbWriter        DbWriterConfig    `yaml:"db_writer"`
+	Retry           RetryConfig       `yaml:"retry"`
+	AvatarUpload    AvatarConfig      `yaml:"avatar_upload"`
+	AvatarFiles     AvatarFilesConfig `yaml:"avatar_files"`
+	Notify          NotifyConfig      `yaml:"notify"`
+	ShutdownTimeout int               `yaml:"shutdown_timeout"` //退出时等待写入数据库的秒数，默认30
+}
+
+//每个学校单独的配置，按学校名称（即数据库名称）索引
+type SchoolConfig struct {
+	Rules     map[string][]SelectionRule `yaml:"rules"` //按课程类别配置的选课规则
+	StudentId StudentIdConfig            `yaml:"student_id"`
+	Calendar  CalendarConfig             `yaml:"calendar"`
+	Sessions  map[string]SessionConfig   `yaml:"sessions"` //按课程类别配置报名方式
+
+	SharedSeats bool `yaml:"shared_seats"` //多个实例同时为本校服务，名额由数据库统一计算
+	SeatSync    int  `yaml:"seat_sync"`    //从数据库同步报名人数的间隔秒数，默认1
+	Roster      bool `yaml:"roster"`       //只允许学生名册中在读的学生登录和报名
 }
 
+var config = Config{}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		runLoadgen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "notify-sink" {
+		runNotifySink(os.Args[2:])
+		return
+	}
+
 	cpus := runtime.NumCPU()
 	p := flag.Int("p", cpus-2, "number of cpu to run on")
 	ds := flag.String("ds", "localhost", "ip address of db server")
@@ -29,12 +67,16 @@ func main() {
 	runtime.GOMAXPROCS(*p)
 
 	path, _ := filepath.Abs(filepath.Dir(os.Args[0]))
-	config := Config{}
 	setting, err := ioutil.ReadFile(path + "/config.yaml")
 	if err != nil {
 		log.Fatalf("error: %v", err)
 	}
 	yaml.Unmarshal(setting, &config)
+	if err = validateConfig(config); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	limiter.configure(config.RateLimit)
+	initTokenSecret()
 
 	fmt.Println("Loading database...")
 	err = initDb(*ds)
@@ -42,38 +84,42 @@ func main() {
 		log.Fatal(err)
 	}
 	fmt.Println("Done.")
+	retryConfig = config.Retry.withDefaults()
+	if !filepath.IsAbs(retryConfig.DeadLetterPath) {
+		retryConfig.DeadLetterPath = filepath.Join(path, retryConfig.DeadLetterPath)
+	}
+	if letters, err := deadLetters.list(); err == nil && len(letters) > 0 {
+		ColorRed(fmt.Sprintf("死信队列中有%d条数据没有写入数据库", len(letters)))
+	}
+	startDbWriters(config.DbWriter)
+	notify := config.Notify.withDefaults()
+	if !filepath.IsAbs(notify.FailedPath) {
+		notify.FailedPath = filepath.Join(path, notify.FailedPath)
+	}
+	if !filepath.IsAbs(notify.OutboxPath) {
+		notify.OutboxPath = filepath.Join(path, notify.OutboxPath)
+	}
+	startNotifiers(notify)
 
 	time.AfterFunc(time.Second, IntervalHandler)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		fmt.Println("Starting server on port:443 ...")
-		http.Handle("/avatar/",
-			http.StripPrefix("/avatar/", FileServer(config.Avatar)))
-		http.HandleFunc("/cancel", handleCancel)
-		http.HandleFunc("/course", handleCourse)
-		http.HandleFunc("/status", handleStatus)
-		http.HandleFunc("/login", handleLogin)
-		http.HandleFunc("/register", handleRegister)
-		http.HandleFunc("/authorize", handleAuthorize)
-		http.HandleFunc("/get-timer", handleGetTimer)
-		http.HandleFunc("/set-timer", handleSetTimer)
-		http.HandleFunc("/register-info", handleRegisterInfo)
-		http.HandleFunc("/register-history", handleRegisterHistory)
-
-		srv := &http.Server{
-			Addr:        ":443",
-			ReadTimeout: 5 * time.Second,
+		routes()
+		err := startServer(config.Server, cancel)
+		if err != nil {
+			log.Fatal(err)
 		}
-
-		cancel()
-		log.Fatal(srv.ListenAndServeTLS(config.Cert, config.Key))
 	}()
 
 	<-ctx.Done()
 	fmt.Println("Done.")
+	handleSignals()
 
 	ziphttp.CmdLineLoop(prompt, func(input string) int {
+		if atomic.LoadInt32(&cmdStopped) != 0 {
+			return Quit()
+		}
 		handler, ok := CmdLineHandler[input]
 		if ok {
 			return handler.Handle()
@@ -81,4 +127,49 @@ func main() {
 
 		return Continue()
 	})
+	shutdown()
+}
+
+//检查配置中启动后才会用到的部分，有错误时不能启动
+func validateConfig(cfg Config) error {
+	if err := compileStudentIds(cfg.Schools); err != nil {
+		return err
+	}
+	return validateSessions(cfg.Schools)
+}
+
+func routes() {
+	http.Handle("/", webHandler())
+	http.Handle("/avatar/",
+		http.StripPrefix("/avatar/", FileServer(config.Avatar)))
+	http.HandleFunc("/cancel", rateLimited("cancel", handleCancel))
+	http.HandleFunc("/course", rateLimited("course", handleCourse))
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/login", handleLogin)
+	http.HandleFunc("/register", rateLimited("register", handleRegister))
+	http.HandleFunc("/rate-limit", adminOnly(handleRateLimitStats))
+	http.HandleFunc("/authorize", handleAuthorize)
+	http.HandleFunc("/children", handleChildren)
+	http.HandleFunc("/get-timer", handleGetTimer)
+	http.HandleFunc("/set-timer", handleSetTimer)
+	http.HandleFunc("/register-info", handleRegisterInfo)
+	http.HandleFunc("/register-history", handleRegisterHistory)
+	http.HandleFunc("/avatar-upload", rateLimited("avatar", handleAvatarUpload))
+	http.HandleFunc("/lottery", handleLottery)
+	http.HandleFunc("/preference", handlePreference)
+	http.HandleFunc("/preference-info", handlePreferenceInfo)
+	http.HandleFunc("/allocation-report", handleAllocationReport)
+	http.HandleFunc("/audit", adminOnly(handleAudit))
+	http.HandleFunc("/audit-verify", adminOnly(handleAuditVerify))
+	http.HandleFunc("/admin/enroll", adminOnly(handleAdminOverride(auditAdminEnroll)))
+	http.HandleFunc("/admin/drop", adminOnly(handleAdminOverride(auditAdminDrop)))
+	http.HandleFunc("/admin/dead-letter", adminOnly(handleDeadLetter))
+	http.HandleFunc("/admin/dead-letter/replay", adminOnly(handleDeadLetterReplay))
+	http.HandleFunc("/admin/synthetic", adminOnly(handleSynthetic))
+	http.HandleFunc("/admin/dashboard", adminOnly(handleDashboard))
+	http.HandleFunc("/admin/notify", adminOnly(handleNotifyStats))
+	http.HandleFunc("/admin/roster", adminOnly(handleRoster))
+	http.HandleFunc("/admin/roster/edit", adminOnly(handleRosterEdit))
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 }